@@ -1,17 +1,116 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	common "github.com/mimiro-io/common-datalayer"
 	pgl "github.com/mimiro-io/postgresql-datalayer/internal/layer"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 func main() {
 	configFolderLocation := ""
 	args := os.Args[1:]
+	if len(args) >= 1 && args[0] == "tombstone-ddl" {
+		tombstoneDDL(args[1:])
+		return
+	}
+	if len(args) >= 1 && args[0] == "introspect" {
+		introspect(args[1:])
+		return
+	}
 	if len(args) >= 1 {
 		configFolderLocation = args[0]
 	}
 
 	common.NewServiceRunner(pgl.NewPgsqlDataLayer).WithConfigLocation(configFolderLocation).WithEnrichConfig(pgl.EnrichConfig).StartAndWait()
 }
+
+// tombstoneDDL prints the statements that set up a tombstone table for a table
+func tombstoneDDL(args []string) {
+	flags := flag.NewFlagSet("tombstone-ddl", flag.ExitOnError)
+	table := flags.String("table", "", "the table to track deletes of")
+	tombstoneTable := flags.String("tombstone-table", "", "the tombstone table, defaults to <table>_tombstone")
+	idColumn := flags.String("id-column", "id", "the identity column of the table")
+	sinceColumn := flags.String("since-column", "", "the since column of the table")
+	flags.Parse(args)
+
+	if *table == "" || *sinceColumn == "" {
+		fmt.Fprintln(os.Stderr, "table and since-column are required")
+		flags.Usage()
+		os.Exit(2)
+	}
+	fmt.Print(pgl.TombstoneDDL(*table, *tombstoneTable, *idColumn, *sinceColumn))
+}
+
+// introspect prints dataset definitions for the tables of a schema, connecting with the
+// system_config of the layer configuration
+func introspect(args []string) {
+	flags := flag.NewFlagSet("introspect", flag.ExitOnError)
+	configLocation := flags.String("config", "", "the layer configuration folder, defaults to DATALAYER_CONFIG_PATH or ./config")
+	schema := flags.String("schema", "", "the schema to read the tables of, defaults to the schema of the system_config or public")
+	tables := flags.String("tables", "", "comma separated tables to generate definitions for, defaults to all tables of the schema")
+	baseURI := flags.String("base-uri", "http://data.example.io/", "the base uri of the entities, followed by the table name")
+	flags.Parse(args)
+
+	config, err := systemConfig(*configLocation)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var tableList []string
+	if *tables != "" {
+		for _, t := range strings.Split(*tables, ",") {
+			tableList = append(tableList, strings.TrimSpace(t))
+		}
+	}
+	datasets, err := pgl.Introspect(context.Background(), config, *schema, tableList, *baseURI)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "    ")
+	if err := out.Encode(map[string]any{"dataset_definitions": datasets}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// systemConfig reads the system_config of the configuration files in the folder, with the
+// environment overrides of the layer applied
+func systemConfig(location string) (*common.Config, error) {
+	if location == "" {
+		location = os.Getenv("DATALAYER_CONFIG_PATH")
+	}
+	if location == "" {
+		location = "./config"
+	}
+	files, err := filepath.Glob(filepath.Join(location, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	config := &common.Config{NativeSystemConfig: map[string]any{}}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var partial common.Config
+		if err := json.Unmarshal(data, &partial); err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", file, err)
+		}
+		// like the layer, the last system config read wins
+		if partial.NativeSystemConfig != nil {
+			config.NativeSystemConfig = partial.NativeSystemConfig
+		}
+	}
+	return config, pgl.EnrichConfig(config)
+}
@@ -1,7 +1,9 @@
 package postgres
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"github.com/docker/go-connections/nat"
 	"github.com/jackc/pgx/v4"
 	common "github.com/mimiro-io/common-datalayer"
@@ -9,9 +11,12 @@ import (
 	pgl "github.com/mimiro-io/postgresql-datalayer/internal/layer"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
+	"io"
+	"maps"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -29,6 +34,7 @@ func setup(t *testing.T) testcontainers.Container {
 		Image:        "postgres",
 		ExposedPorts: []string{"5432/tcp"},
 		Env:          map[string]string{"POSTGRES_HOST_AUTH_METHOD": "trust", "POSTGRES_DB": "psql_test"},
+		Cmd:          []string{"postgres", "-c", "wal_level=logical"},
 		WaitingFor:   wait.ForLog("listening on IPv4 address"),
 	}
 	postgresC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
@@ -64,6 +70,39 @@ func setup(t *testing.T) testcontainers.Container {
 		t.Fatalf("Failed to create table: %v", err)
 	}
 
+	_, err = conn.Exec(context.Background(), `ALTER TABLE product REPLICA IDENTITY FULL;
+		CREATE PUBLICATION products_pub FOR TABLE product;`)
+	if err != nil {
+		t.Fatalf("Failed to create publication: %v", err)
+	}
+
+	_, err = conn.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS gadget (
+		id INT PRIMARY KEY, name VARCHAR(15), updated TIMESTAMP);`)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	_, err = conn.Exec(context.Background(), pgl.TombstoneDDL("gadget", "", "id", "updated"))
+	if err != nil {
+		t.Fatalf("Failed to create tombstone table: %v", err)
+	}
+
+	_, err = conn.Exec(context.Background(), `CREATE EXTENSION IF NOT EXISTS hstore;
+		CREATE TYPE mood AS ENUM ('happy', 'sad');
+		CREATE TABLE IF NOT EXISTS typed (
+		id INT PRIMARY KEY, amount NUMERIC(20,4), uid UUID, data BYTEA, duration INTERVAL, tags TEXT[],
+		addr INET, feeling mood, attrs HSTORE, span INT4RANGE, created TIMESTAMPTZ, day DATE, related INT[]);`)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	_, err = conn.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS invoice (
+		id INT PRIMARY KEY, customer VARCHAR(15));
+		CREATE TABLE IF NOT EXISTS invoice_line (
+		id INT PRIMARY KEY, invoice_id INT REFERENCES invoice (id), pos INT, item VARCHAR(15));`)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
 	_, err = conn.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS customer (
 		id VARCHAR PRIMARY KEY, entity JSONB, last_modified TIMESTAMP);`)
 	if err != nil {
@@ -106,6 +145,43 @@ func teardown(t *testing.T, postgresC testcontainers.Container) {
 	service.Stop()
 }
 
+// readChanges reads the changes of the dataset at the url since the token
+func readChanges(t *testing.T, datasetUrl string, since string) *egdm.EntityCollection {
+	t.Helper()
+	res, err := http.Get(datasetUrl + "/changes?since=" + since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d", res.StatusCode)
+	}
+	ec, err := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs().LoadEntityCollection(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ec
+}
+
+// testNativeConfig returns the settings connecting to the test database, together with the given settings
+func testNativeConfig(settings map[string]any) map[string]any {
+	native := map[string]any{"user": "postgres", "password": "postgres", "database": "psql_test", "host": conn.Config().Host, "port": fmt.Sprint(conn.Config().Port)}
+	maps.Copy(native, settings)
+	return native
+}
+
+// newTestLayer starts a layer serving the datasets from the test database, with the given native
+// settings. The layer is stopped when the test ends.
+func newTestLayer(t *testing.T, native map[string]any, datasets ...*common.DatasetDefinition) (*pgl.PgsqlDatalayer, *common.Config) {
+	t.Helper()
+	config := &common.Config{NativeSystemConfig: testNativeConfig(native), DatasetDefinitions: datasets}
+	layer, err := pgl.NewPgsqlDataLayer(config, common.NewLogger("test", "text", "info"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { layer.Stop(context.Background()) })
+	return layer.(*pgl.PgsqlDatalayer), config
+}
+
 func TestDatasetEndpoint(t *testing.T) {
 	postgresC := setup(t)
 	defer teardown(t, postgresC)
@@ -432,4 +508,765 @@ func TestDatasetEndpoint(t *testing.T) {
 		}
 	})
 
+	t.Run("Should replace table contents with full sync", func(t *testing.T) {
+		_, err := conn.Exec(context.Background(), "INSERT INTO product (id, product_id) VALUES (999, 999)")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		postBatch := func(file string, start, end bool) int {
+			fileBytes, _ := os.ReadFile(file)
+			req, _ := http.NewRequest(http.MethodPost, layerUrl+"/entities", strings.NewReader(string(fileBytes)))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("universal-data-api-full-sync-id", "sync-1")
+			if start {
+				req.Header.Set("universal-data-api-full-sync-start", "true")
+			}
+			if end {
+				req.Header.Set("universal-data-api-full-sync-end", "true")
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return res.StatusCode
+		}
+
+		if status := postBatch("./resources/test/testdata_1.json", true, false); status != http.StatusOK {
+			t.Fatalf("Unexpected status for start batch: %d", status)
+		}
+
+		var count int
+		conn.QueryRow(context.Background(), "SELECT COUNT(*) FROM product").Scan(&count)
+		if count != 1 {
+			t.Fatalf("Expected live table to be untouched during full sync, got %d rows", count)
+		}
+
+		if status := postBatch("./resources/test/testdata_2.json", false, true); status != http.StatusOK {
+			t.Fatalf("Unexpected status for last batch: %d", status)
+		}
+
+		conn.QueryRow(context.Background(), "SELECT COUNT(*) FROM product").Scan(&count)
+		if count != 9 {
+			t.Fatalf("Expected 9 rows after full sync, got %d", count)
+		}
+		conn.QueryRow(context.Background(), "SELECT COUNT(*) FROM product WHERE id = 999").Scan(&count)
+		if count != 0 {
+			t.Fatalf("Expected row missing from full sync to be removed")
+		}
+
+		// a batch for a sync that is no longer in progress must be rejected
+		if status := postBatch("./resources/test/testdata_1.json", false, true); status == http.StatusOK {
+			t.Fatalf("Expected batch for finished sync to be rejected")
+		}
+	})
+
+	t.Run("Should full sync tables with generated columns", func(t *testing.T) {
+		_, err := conn.Exec(context.Background(), `CREATE TABLE gauge (
+			seq INT GENERATED ALWAYS AS IDENTITY, label TEXT GENERATED ALWAYS AS (upper(name)) STORED,
+			name TEXT, id INT PRIMARY KEY)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer, _ := newTestLayer(t, nil, &common.DatasetDefinition{
+			DatasetName:  "gauges",
+			SourceConfig: map[string]any{"table_name": "gauge"},
+			IncomingMappingConfig: &common.IncomingMappingConfig{
+				BaseURI: "http://data.sample.org/",
+				PropertyMappings: []*common.EntityToItemPropertyMapping{
+					{Property: "id", IsIdentity: true, StripReferencePrefix: true},
+					{EntityProperty: "name", Property: "name"},
+				},
+			},
+		})
+
+		ds, _ := layer.Dataset("gauges")
+		writer, lerr := ds.FullSync(context.Background(), common.BatchInfo{SyncId: "gauges-1", IsStartBatch: true, IsLastBatch: true})
+		if lerr == nil {
+			entity := egdm.NewEntity().SetID("http://data.sample.org/1")
+			entity.Properties["http://data.sample.org/name"] = "dial"
+			lerr = writer.Write(entity)
+			if lerr == nil {
+				lerr = writer.Close()
+			}
+		}
+		if lerr != nil {
+			t.Fatal(lerr)
+		}
+
+		var label string
+		if err := conn.QueryRow(context.Background(), "SELECT label FROM gauge WHERE id = 1").Scan(&label); err != nil || label != "DIAL" {
+			t.Fatalf("Expected the generated label DIAL, got %q, %v", label, err)
+		}
+
+		// a table named like the staging table that the layer did not create is not dropped
+		if _, err = conn.Exec(context.Background(), "CREATE TABLE gauge_fullsync (note TEXT)"); err != nil {
+			t.Fatal(err)
+		}
+		_, lerr = ds.FullSync(context.Background(), common.BatchInfo{SyncId: "gauges-2", IsStartBatch: true})
+		if lerr == nil || !strings.Contains(lerr.Error(), "is not a full sync staging table") {
+			t.Fatalf("Expected the start batch to fail, got %v", lerr)
+		}
+		var exists bool
+		if err := conn.QueryRow(context.Background(), "SELECT to_regclass('gauge_fullsync') IS NOT NULL").Scan(&exists); err != nil || !exists {
+			t.Fatalf("Expected the table to be kept, got %v", err)
+		}
+	})
+
+	t.Run("Should write batches with the copy strategy", func(t *testing.T) {
+		_, err := conn.Exec(context.Background(), "DELETE FROM product")
+		if err != nil {
+			t.Fatal(err)
+		}
+		copyUrl := "http://localhost:17777/datasets/products_copy"
+
+		fileBytes, _ := os.ReadFile("./resources/test/testdata_1.json")
+		res, err := http.Post(copyUrl+"/entities", "application/json", strings.NewReader(string(fileBytes)))
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected response: %v", err)
+		}
+
+		var count int
+		conn.QueryRow(context.Background(), "SELECT COUNT(*) FROM product").Scan(&count)
+		if count != 10 {
+			t.Fatalf("Expected 10 rows, got %d", count)
+		}
+
+		fileBytes, _ = os.ReadFile("./resources/test/testdata_2.json")
+		res, err = http.Post(copyUrl+"/entities", "application/json", strings.NewReader(string(fileBytes)))
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected response: %v", err)
+		}
+
+		conn.QueryRow(context.Background(), "SELECT COUNT(*) FROM product").Scan(&count)
+		if count != 9 {
+			t.Fatalf("Expected 9 rows after deletion, got %d", count)
+		}
+	})
+
+	t.Run("Should copy into tables with a NOT NULL since column", func(t *testing.T) {
+		_, err := conn.Exec(context.Background(), `CREATE TABLE meter (id INT PRIMARY KEY, name TEXT, updated TIMESTAMP NOT NULL)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer, _ := newTestLayer(t, nil, &common.DatasetDefinition{
+			DatasetName:  "meters",
+			SourceConfig: map[string]any{"table_name": "meter", "since_column": "updated", "since_datatype": "time", "write_strategy": "copy"},
+			IncomingMappingConfig: &common.IncomingMappingConfig{
+				BaseURI: "http://data.sample.org/",
+				PropertyMappings: []*common.EntityToItemPropertyMapping{
+					{Property: "id", IsIdentity: true, StripReferencePrefix: true},
+					{EntityProperty: "name", Property: "name"},
+				},
+			},
+		})
+
+		ds, _ := layer.Dataset("meters")
+		writer, lerr := ds.Incremental(context.Background())
+		for i := 1; lerr == nil && i <= 2; i++ {
+			entity := egdm.NewEntity().SetID(fmt.Sprintf("http://data.sample.org/%d", i))
+			entity.Properties["http://data.sample.org/name"] = "gauge"
+			lerr = writer.Write(entity)
+		}
+		if lerr == nil {
+			lerr = writer.Close()
+		}
+		if lerr != nil {
+			t.Fatal(lerr)
+		}
+
+		var count int
+		conn.QueryRow(context.Background(), "SELECT COUNT(*) FROM meter WHERE updated IS NOT NULL").Scan(&count)
+		if count != 2 {
+			t.Fatalf("Expected 2 rows with their since value set, got %d", count)
+		}
+	})
+
+	t.Run("Should page through entities with the from token", func(t *testing.T) {
+		readEntities := func(query string) *egdm.EntityCollection {
+			res, err := http.Get(layerUrl + "/entities" + query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ec, err := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs().LoadEntityCollection(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ec
+		}
+
+		ec := readEntities("")
+		total := len(ec.Entities)
+		if total == 0 {
+			t.Fatal("Expected entities in snapshot")
+		}
+
+		ec = readEntities("?limit=5")
+		if len(ec.Entities) != 5 {
+			t.Fatalf("Expected 5 entities, got %d", len(ec.Entities))
+		}
+		ec = readEntities("?limit=5&from=" + ec.Continuation.Token)
+		if len(ec.Entities) != total-5 {
+			t.Fatalf("Expected %d entities on second page, got %d", total-5, len(ec.Entities))
+		}
+
+		// the token of the last page ends the snapshot
+		last := ec.Continuation.Token
+		if ec = readEntities("?limit=5&from=" + last); len(ec.Entities) != 0 {
+			t.Fatalf("Expected no entities after the last page, got %d", len(ec.Entities))
+		}
+
+		// the token of the last page follows the changes from before the snapshot
+		res, err := http.Get(layerUrl + "/changes?since=" + last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ec, err = egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs().LoadEntityCollection(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ec.Entities) != 0 {
+			t.Fatalf("Expected no changes after the snapshot, got %d", len(ec.Entities))
+		}
+	})
+
+	t.Run("Should read inserts, updates and deletes from the replication slot", func(t *testing.T) {
+		cdcUrl := "http://localhost:17777/datasets/products_cdc"
+		_, err := conn.Exec(context.Background(), "DELETE FROM product")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Exec(context.Background(), "INSERT INTO product (id, product_id) VALUES (1, 10), (2, 20)")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the first read is a snapshot of the table
+		ec := readChanges(t, cdcUrl, "")
+		if len(ec.Entities) != 2 {
+			t.Fatalf("Expected 2 entities in snapshot, got %d", len(ec.Entities))
+		}
+
+		_, err = conn.Exec(context.Background(), "UPDATE product SET product_id = 11 WHERE id = 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Exec(context.Background(), "DELETE FROM product WHERE id = 2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Exec(context.Background(), "INSERT INTO product (id, product_id) VALUES (3, 30)")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ec = readChanges(t, cdcUrl, ec.Continuation.Token)
+		if len(ec.Entities) != 3 {
+			t.Fatalf("Expected 3 changes, got %d", len(ec.Entities))
+		}
+		if ec.Entities[0].Properties["http://data.sample.org/product_id"] != float64(11) {
+			t.Fatalf("Expected updated product_id, got %v", ec.Entities[0].Properties)
+		}
+		if ec.Entities[1].ID != "http://data.sample.org/things/2" || !ec.Entities[1].IsDeleted {
+			t.Fatalf("Expected entity 2 to be deleted, got %+v", ec.Entities[1])
+		}
+
+		// reading from the last token returns nothing new
+		ec = readChanges(t, cdcUrl, ec.Continuation.Token)
+		if len(ec.Entities) != 0 {
+			t.Fatalf("Expected 0 changes, got %d", len(ec.Entities))
+		}
+	})
+
+	t.Run("Should read hard deletes from the tombstone table", func(t *testing.T) {
+		gadgetUrl := "http://localhost:17777/datasets/gadgets"
+		_, err := conn.Exec(context.Background(), "INSERT INTO gadget (id, name, updated) VALUES (1, 'a', NOW()), (2, 'b', NOW())")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ec := readChanges(t, gadgetUrl, "")
+		if len(ec.Entities) != 2 {
+			t.Fatalf("Expected 2 entities, got %d", len(ec.Entities))
+		}
+
+		_, err = conn.Exec(context.Background(), "DELETE FROM gadget WHERE id = 2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ec = readChanges(t, gadgetUrl, ec.Continuation.Token)
+		if len(ec.Entities) != 1 {
+			t.Fatalf("Expected 1 change, got %d", len(ec.Entities))
+		}
+		if ec.Entities[0].ID != "http://data.sample.org/gadgets/2" || !ec.Entities[0].IsDeleted {
+			t.Fatalf("Expected entity 2 to be deleted, got %+v", ec.Entities[0])
+		}
+
+		ec = readChanges(t, gadgetUrl, ec.Continuation.Token)
+		if len(ec.Entities) != 0 {
+			t.Fatalf("Expected 0 changes, got %d", len(ec.Entities))
+		}
+
+		// rows deleted and inserted again, as the layer writes them, leave no tombstones
+		_, err = conn.Exec(context.Background(), "BEGIN; DELETE FROM gadget WHERE id = 1; INSERT INTO gadget (id, name, updated) VALUES (1, 'a', NOW()); COMMIT")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		conn.QueryRow(context.Background(), "SELECT COUNT(*) FROM gadget_tombstone WHERE id = 1").Scan(&count)
+		if count != 0 {
+			t.Fatalf("Expected no tombstone of the row written again, got %d", count)
+		}
+	})
+
+	t.Run("Should read and write back values of all column types", func(t *testing.T) {
+		typedUrl := "http://localhost:17777/datasets/typed"
+		_, err := conn.Exec(context.Background(), `INSERT INTO typed VALUES (1, 1234.5,
+			'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11', '\x01ab', '1 day 02:00:00', '{a,"b c",NULL}', '192.168.0.1/24',
+			'happy', 'a=>1, b=>NULL', '[1,10)', '2024-01-02 10:30:00+02', '2024-01-02', '{2,3}')`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.Get(typedUrl + "/entities")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ec, err := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs().LoadEntityCollection(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ec.Entities) != 1 {
+			t.Fatalf("Expected 1 entity, got %d", len(ec.Entities))
+		}
+
+		props := ec.Entities[0].Properties
+		expected := map[string]any{
+			"amount":   1234.5,
+			"uid":      "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11",
+			"data":     `\x01ab`,
+			"duration": "1 day 02:00:00",
+			"tags":     []any{"a", "b c", nil},
+			"addr":     "192.168.0.1/24",
+			"feeling":  "happy",
+			"attrs":    `"a"=>"1", "b"=>NULL`,
+			"span":     "[1,10)",
+			"day":      "2024-01-02",
+		}
+		for name, value := range expected {
+			got := props["http://data.sample.org/typed/"+name]
+			if fmt.Sprint(got) != fmt.Sprint(value) {
+				t.Errorf("Unexpected value for %s: got %#v, want %#v", name, got, value)
+			}
+		}
+		// the instant is compared, its text depends on the time zone of the layer and the database
+		created, err := time.Parse(time.RFC3339, fmt.Sprint(props["http://data.sample.org/typed/created"]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := time.Parse(time.RFC3339, "2024-01-02T10:30:00+02:00"); !created.Equal(want) {
+			t.Errorf("Unexpected value for created: got %s, want %s", created, want)
+		}
+
+		related := ec.Entities[0].References["http://data.sample.org/typed/related"]
+		if fmt.Sprint(related) != "[http://data.sample.org/typed/2 http://data.sample.org/typed/3]" {
+			t.Errorf("Unexpected related references %v", related)
+		}
+
+		// write the entity back as another row, it must hold the same values
+		ec.Entities[0].ID = "http://data.sample.org/typed/2"
+		ec.Continuation = nil
+		var body strings.Builder
+		if err := ec.WriteEntityGraphJSON(&body); err != nil {
+			t.Fatal(err)
+		}
+		res, err = http.Post(typedUrl+"/entities", "application/json", strings.NewReader(body.String()))
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected response: %v", err)
+		}
+
+		var equal bool
+		err = conn.QueryRow(context.Background(), `SELECT a.uid = b.uid AND a.data = b.data AND a.duration = b.duration
+			AND a.addr = b.addr AND a.feeling = b.feeling AND a.attrs = b.attrs AND a.span = b.span
+			AND a.created = b.created AND a.day = b.day AND a.amount = b.amount
+			AND a.tags IS NOT DISTINCT FROM b.tags AND a.related = b.related
+			FROM typed a, typed b WHERE a.id = 1 AND b.id = 2`).Scan(&equal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equal {
+			t.Fatal("Expected the written row to hold the values of the read row")
+		}
+	})
+
+	t.Run("Should embed child rows as sub-entities", func(t *testing.T) {
+		_, err := conn.Exec(context.Background(), `INSERT INTO invoice (id, customer) VALUES (1, 'c1'), (2, 'c2');
+			INSERT INTO invoice_line (id, invoice_id, pos, item) VALUES (11, 1, 2, 'b'), (10, 1, 1, 'a')`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.Get("http://localhost:17777/datasets/invoices/entities")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ec, err := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs().LoadEntityCollection(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ec.Entities) != 2 {
+			t.Fatalf("Expected 2 entities, got %d", len(ec.Entities))
+		}
+
+		lines, ok := ec.Entities[0].Properties["http://data.sample.org/invoices/lines"].([]any)
+		if !ok || len(lines) != 2 {
+			t.Fatalf("Expected 2 lines in invoice 1, got %s", body)
+		}
+		first := strings.Index(string(body), "invoice_lines/10")
+		second := strings.Index(string(body), "invoice_lines/11")
+		if first < 0 || second < first {
+			t.Fatalf("Expected lines ordered by position, got %s", body)
+		}
+		if lines, _ := ec.Entities[1].Properties["http://data.sample.org/invoices/lines"].([]any); len(lines) != 0 {
+			t.Fatalf("Expected no lines in invoice 2, got %v", lines)
+		}
+	})
+
+	t.Run("Should replace child rows with the sub-entities of written entities", func(t *testing.T) {
+		payload := strings.NewReader(`[
+			{"id": "@context", "namespaces": {"_": "http://data.sample.org/invoices/", "l": "http://data.sample.org/invoice_lines/"}},
+			{"id": "_:1", "props": {"_:customer": "c1", "_:lines": [
+				{"id": "l:12", "props": {"l:pos": 1, "l:item": "c"}}
+			]}},
+			{"id": "_:3", "props": {"_:customer": "c3", "_:lines": [
+				{"id": "l:30", "props": {"l:pos": 1, "l:item": "x"}},
+				{"id": "l:31", "props": {"l:pos": 2, "l:item": "y"}}
+			]}}
+		]`)
+		res, err := http.Post("http://localhost:17777/datasets/invoices/entities", "application/json", payload)
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected response: %v", err)
+		}
+
+		rows, err := conn.Query(context.Background(), "SELECT id, invoice_id, item FROM invoice_line ORDER BY id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for rows.Next() {
+			var id, invoiceId int
+			var item string
+			if err := rows.Scan(&id, &invoiceId, &item); err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, fmt.Sprintf("%d:%d:%s", id, invoiceId, item))
+		}
+		expected := []string{"12:1:c", "30:3:x", "31:3:y"}
+		if strings.Join(lines, ",") != strings.Join(expected, ",") {
+			t.Fatalf("Expected lines %v, got %v", expected, lines)
+		}
+	})
+
+	t.Run("Should write entities into the entity column and read them back", func(t *testing.T) {
+		payload := strings.NewReader(`[
+			{"id": "@context", "namespaces": {"c": "http://data.example.io/customers/"}},
+			{"id": "c:6", "props": {"c:name": "Alice", "c:age": 42}, "refs": {"c:friend": "c:1"}},
+			{"id": "c:7", "deleted": true, "props": {"c:name": "Bob"}}
+		]`)
+		res, err := http.Post(customerLayerUrl+"/entities", "application/json", payload)
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected response: %v", err)
+		}
+
+		res, err = http.Get(customerLayerUrl + "/changes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ec, err := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs().LoadEntityCollection(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written := map[string]*egdm.Entity{}
+		for _, e := range ec.Entities {
+			written[e.ID] = e
+		}
+
+		alice := written["http://data.example.io/customers/6"]
+		if alice == nil || alice.IsDeleted {
+			t.Fatalf("Expected live entity 6, got %+v", alice)
+		}
+		if alice.Properties["http://data.example.io/customers/name"] != "Alice" ||
+			alice.References["http://data.example.io/customers/friend"] != "http://data.example.io/customers/1" {
+			t.Fatalf("Expected properties and references of entity 6 to be kept, got %+v", alice)
+		}
+		bob := written["http://data.example.io/customers/7"]
+		if bob == nil || !bob.IsDeleted {
+			t.Fatalf("Expected deleted entity 7, got %+v", bob)
+		}
+	})
+
+	t.Run("Should create tables and add columns of newly mapped properties on write", func(t *testing.T) {
+		payload := strings.NewReader(`[
+			{"id": "@context", "namespaces": {"_": "http://data.sample.org/widgets/"}},
+			{"id": "_:1", "props": {"_:name": "cog", "_:size": 1.5, "_:tags": ["a", "b"]}}
+		]`)
+		res, err := http.Post("http://localhost:17777/datasets/widgets/entities", "application/json", payload)
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected response: %v", err)
+		}
+
+		columnTypes := func() string {
+			rows, err := conn.Query(context.Background(), `SELECT column_name, data_type FROM information_schema.columns
+				WHERE table_name = 'widget' ORDER BY ordinal_position`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var columns []string
+			for rows.Next() {
+				var name, dataType string
+				if err := rows.Scan(&name, &dataType); err != nil {
+					t.Fatal(err)
+				}
+				columns = append(columns, name+" "+dataType)
+			}
+			return strings.Join(columns, ", ")
+		}
+		expected := "id bigint, name text, size double precision, tags ARRAY, updated timestamp with time zone"
+		if got := columnTypes(); got != expected {
+			t.Fatalf("Expected columns %s, got %s", expected, got)
+		}
+
+		widgets := func(mappings ...*common.EntityToItemPropertyMapping) *common.DatasetDefinition {
+			return &common.DatasetDefinition{
+				DatasetName:  "widgets",
+				SourceConfig: map[string]any{"table_name": "widget", "since_column": "updated", "auto_create": true},
+				IncomingMappingConfig: &common.IncomingMappingConfig{
+					BaseURI: "http://data.sample.org/widgets/",
+					PropertyMappings: append([]*common.EntityToItemPropertyMapping{
+						{Property: "id", IsIdentity: true, StripReferencePrefix: true, Datatype: "long"},
+						{EntityProperty: "name", Property: "name"},
+						{EntityProperty: "size", Property: "size"},
+						{EntityProperty: "tags", Property: "tags"},
+					}, mappings...),
+				},
+			}
+		}
+		layer, config := newTestLayer(t, nil, widgets())
+
+		config.DatasetDefinitions = []*common.DatasetDefinition{widgets(&common.EntityToItemPropertyMapping{EntityProperty: "weight", Property: "weight", Datatype: "double"})}
+		if err := layer.UpdateConfiguration(config); err != nil {
+			t.Fatal(err)
+		}
+		if got := columnTypes(); got != expected {
+			t.Fatalf("Expected reload to leave the columns unchanged, got %s", got)
+		}
+
+		ds, _ := layer.Dataset("widgets")
+		writer, lerr := ds.Incremental(context.Background())
+		if lerr == nil {
+			entity := egdm.NewEntity().SetID("http://data.sample.org/widgets/2")
+			entity.Properties["http://data.sample.org/widgets/weight"] = 2.5
+			lerr = writer.Write(entity)
+		}
+		if lerr == nil {
+			lerr = writer.Close()
+		}
+		if lerr != nil {
+			t.Fatal(lerr)
+		}
+		if got := columnTypes(); got != expected+", weight double precision" {
+			t.Fatalf("Expected weight column to be added on write, got %s", got)
+		}
+	})
+
+	t.Run("Should cancel reads exceeding the statement timeout of the dataset", func(t *testing.T) {
+		layer, _ := newTestLayer(t, map[string]any{"max_open_connections": 2, "statement_timeout": "1m"}, &common.DatasetDefinition{
+			DatasetName:           "slow_products",
+			SourceConfig:          map[string]any{"data_query": "SELECT p.* FROM product p, (SELECT pg_sleep(2)) s", "statement_timeout": "100ms"},
+			OutgoingMappingConfig: &common.OutgoingMappingConfig{BaseURI: "http://data.sample.org/", MapAll: true},
+		})
+
+		ds, lerr := layer.Dataset("slow_products")
+		if lerr != nil {
+			t.Fatal(lerr)
+		}
+		iter, lerr := ds.Changes("", 0, false)
+		if lerr == nil {
+			for lerr == nil {
+				var entity *egdm.Entity
+				entity, lerr = iter.Next()
+				if entity == nil && lerr == nil {
+					break
+				}
+			}
+			iter.Close()
+		}
+		if lerr == nil || !strings.Contains(lerr.Error(), "statement timeout") {
+			t.Fatalf("Expected the read to be cancelled by the statement timeout, got %v", lerr)
+		}
+	})
+
+	t.Run("Should connect datasets with connection overrides of their own", func(t *testing.T) {
+		_, err := conn.Exec(context.Background(), `CREATE ROLE product_reader LOGIN PASSWORD 'p@ss:w/rd'; GRANT SELECT ON product TO product_reader`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		products := func(name string, sourceConfig map[string]any) *common.DatasetDefinition {
+			sourceConfig["table_name"] = "product"
+			return &common.DatasetDefinition{
+				DatasetName:  name,
+				SourceConfig: sourceConfig,
+				IncomingMappingConfig: &common.IncomingMappingConfig{
+					BaseURI:          "http://data.sample.org/",
+					PropertyMappings: []*common.EntityToItemPropertyMapping{{Property: "id", IsIdentity: true, StripReferencePrefix: true}},
+				},
+				OutgoingMappingConfig: &common.OutgoingMappingConfig{BaseURI: "http://data.sample.org/", MapAll: true},
+			}
+		}
+		layer, _ := newTestLayer(t, nil,
+			products("all_products", map[string]any{}),
+			products("reader_products", map[string]any{"connection": map[string]any{"user": "product_reader", "password": "p@ss:w/rd"}}),
+		)
+
+		count := func(dataset string) int {
+			ds, lerr := layer.Dataset(dataset)
+			if lerr != nil {
+				t.Fatal(lerr)
+			}
+			iter, lerr := ds.Changes("", 0, false)
+			if lerr != nil {
+				t.Fatal(lerr)
+			}
+			defer iter.Close()
+			n := 0
+			for {
+				entity, lerr := iter.Next()
+				if lerr != nil {
+					t.Fatal(lerr)
+				}
+				if entity == nil {
+					return n
+				}
+				n++
+			}
+		}
+		if all, read := count("all_products"), count("reader_products"); all == 0 || all != read {
+			t.Fatalf("Expected the reader to read all %d products, got %d", all, read)
+		}
+
+		ds, _ := layer.Dataset("reader_products")
+		writer, lerr := ds.Incremental(context.Background())
+		if lerr == nil {
+			entity := egdm.NewEntity().SetID("http://data.sample.org/999")
+			lerr = writer.Write(entity)
+			if lerr == nil {
+				lerr = writer.Close()
+			}
+		}
+		if lerr == nil || !strings.Contains(lerr.Error(), "permission denied") {
+			t.Fatalf("Expected writes of the reader to be denied, got %v", lerr)
+		}
+	})
+
+	t.Run("Should read from the read replica", func(t *testing.T) {
+		// the primary stands in for its replica, told apart by the application name
+		native := map[string]any{"read_replicas": []any{map[string]any{"application_name": "replica"}}, "max_replica_lag": "10s"}
+		layer, _ := newTestLayer(t, native, &common.DatasetDefinition{
+			DatasetName:           "replica_products",
+			SourceConfig:          map[string]any{"data_query": "SELECT id, current_setting('application_name') AS reader FROM product"},
+			OutgoingMappingConfig: &common.OutgoingMappingConfig{BaseURI: "http://data.sample.org/", MapAll: true},
+		})
+
+		ds, _ := layer.Dataset("replica_products")
+		iter, lerr := ds.Changes("", 0, false)
+		if lerr != nil {
+			t.Fatal(lerr)
+		}
+		defer iter.Close()
+		entity, lerr := iter.Next()
+		if lerr != nil || entity == nil {
+			t.Fatalf("Expected an entity, got %v", lerr)
+		}
+		if reader := entity.Properties["http://data.sample.org/reader"]; reader != "replica" {
+			t.Fatalf("Expected the read to go to the replica, got %v", reader)
+		}
+	})
+
+	t.Run("Should keep serving reads while the configuration is reloaded", func(t *testing.T) {
+		layer, config := newTestLayer(t, nil, &common.DatasetDefinition{
+			DatasetName:           "reloaded_products",
+			SourceConfig:          map[string]any{"table_name": "product"},
+			OutgoingMappingConfig: &common.OutgoingMappingConfig{BaseURI: "http://data.sample.org/", MapAll: true},
+		})
+
+		var readers sync.WaitGroup
+		stop := make(chan struct{})
+		for i := 0; i < 4; i++ {
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					ds, lerr := layer.Dataset("reloaded_products")
+					if lerr != nil {
+						t.Error(lerr)
+						return
+					}
+					iter, lerr := ds.Entities("", 0)
+					for lerr == nil {
+						var entity *egdm.Entity
+						if entity, lerr = iter.Next(); entity == nil {
+							break
+						}
+					}
+					if iter != nil {
+						iter.Close()
+					}
+					if lerr != nil {
+						t.Error(lerr)
+						return
+					}
+				}
+			}()
+		}
+		for i := 0; i < 10; i++ {
+			if err := layer.UpdateConfiguration(config); err != nil {
+				t.Error(err)
+			}
+		}
+		close(stop)
+		readers.Wait()
+	})
+
+	t.Run("Should generate dataset definitions from the schema", func(t *testing.T) {
+		config := &common.Config{NativeSystemConfig: testNativeConfig(nil)}
+		datasets, err := pgl.Introspect(context.Background(), config, "public", []string{"invoice_line"}, "http://data.example.io/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(datasets) != 1 || datasets[0].Name != "invoice_line" {
+			t.Fatalf("Expected a definition for invoice_line, got %v", datasets)
+		}
+		var identity, reference string
+		for _, pm := range datasets[0].OutgoingMappingConfig.PropertyMappings {
+			if pm.IsIdentity {
+				identity = pm.Property
+			}
+			if pm.IsReference {
+				reference = pm.Property + " " + pm.URIValuePattern
+			}
+		}
+		if identity != "id" || reference != "invoice_id http://data.example.io/invoice/{value}" {
+			t.Fatalf("Expected identity id and reference to invoices, got %s and %s", identity, reference)
+		}
+	})
 }
@@ -0,0 +1,675 @@
+package layer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+// logical decoding output plugins supported by the change feed
+const (
+	PgOutputPlugin = "pgoutput"
+	Wal2JsonPlugin = "wal2json"
+)
+
+// newCDCIterator reads changes from the logical replication slot configured for the dataset.
+// The continuation token is the LSN at the end of the last transaction returned. Before
+// peeking at the slot it is advanced to the given since token, so the slot only retains WAL
+// the consumer has not seen yet. Without a since token the current table contents are
+// returned as a snapshot, together with the WAL position taken before the snapshot was read.
+// With a limit the snapshot is paged by identity, the token of a full page holds the WAL
+// position of the snapshot and the identity of its last row.
+//
+// The limit of changes is passed to the slot as the number of decoded messages to read, which
+// includes the begin, commit and relation messages and the changes of other tables. It is only
+// checked after a complete transaction, so a page holds fewer or more changes than the limit.
+func (d *Dataset) newCDCIterator(mapper *cdl.Mapper, since string, limit int) (cdl.EntityIterator, cdl.LayerError) {
+	slot := getStringConfigProperty(d.datasetDefinition.SourceConfig, CdcSlot)
+	plugin := getStringConfigProperty(d.datasetDefinition.SourceConfig, CdcPlugin)
+	if plugin == "" {
+		plugin = PgOutputPlugin
+	}
+	publication := getStringConfigProperty(d.datasetDefinition.SourceConfig, CdcPublication)
+	if plugin == PgOutputPlugin && publication == "" {
+		return nil, ErrGeneric("cdc publication must be set for plugin %s in dataset %s", plugin, d.Name())
+	}
+	if plugin != PgOutputPlugin && plugin != Wal2JsonPlugin {
+		return nil, ErrGeneric("unsupported cdc plugin %s in dataset %s", plugin, d.Name())
+	}
+
+	// no timeout unless a read timeout is configured, to support long running stream operations
+	ctx, cancel, cerr := d.readContext()
+	if cerr != nil {
+		return nil, ErrQuery(cerr)
+	}
+	started := false
+	defer func() {
+		if !started {
+			cancel()
+		}
+	}()
+	db := d.db.db
+
+	err := checkReplicaIdentity(ctx, db, tableRef(d.schema(), getStringConfigProperty(d.datasetDefinition.SourceConfig, TableName)))
+	if err != nil {
+		d.logger.Error("table not prepared for change data capture", "error", err, "dataset", d.Name())
+		return nil, cdl.Err(err, cdl.LayerErrorBadParameter)
+	}
+	confirmed, err := ensureReplicationSlot(ctx, db, slot, plugin)
+	if err != nil {
+		d.logger.Error("failed to prepare replication slot", "error", err, "slot", slot)
+		return nil, ErrQuery(err)
+	}
+
+	snapshot, paging := decodeSnapshotToken(since)
+	if since == "" || paging {
+		var current, from string
+		if paging {
+			// the slot has been advanced to the snapshot by its first page
+			current = snapshot.Until
+			from = base64.URLEncoding.EncodeToString([]byte(snapshot.After))
+		} else {
+			err = db.QueryRowContext(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&current)
+			if err != nil {
+				return nil, ErrQuery(err)
+			}
+			err = advanceReplicationSlot(ctx, db, slot, current, confirmed)
+			if err != nil {
+				return nil, ErrQuery(err)
+			}
+		}
+
+		query, args, err := buildSnapshotQuery(d.datasetDefinition, d.schema(), from, limit)
+		if err != nil {
+			return nil, ErrQuery(err)
+		}
+		iter, lerr := d.queryIterator(ctx, d.db, mapper, query, args, "", limit, encodeLSNToken(current))
+		if lerr != nil {
+			return nil, lerr
+		}
+		if limit != 0 {
+			iter.tokenColumn = columnKey(identityColumn(d.datasetDefinition))
+			iter.snapshotSince = current
+			iter.endToken = encodeLSNToken(current)
+		}
+		iter.cancel = cancel
+		started = true
+		return iter, nil
+	}
+
+	sinceLSN, err := decodeLSNToken(since)
+	if err != nil {
+		return nil, cdl.Err(fmt.Errorf("invalid since token: %w", err), cdl.LayerErrorBadParameter)
+	}
+	if lsnLess(sinceLSN, confirmed) {
+		return nil, cdl.Err(fmt.Errorf("since token %s is behind replication slot %s at %s", sinceLSN, slot, confirmed), cdl.LayerErrorBadParameter)
+	}
+	err = advanceReplicationSlot(ctx, db, slot, sinceLSN, confirmed)
+	if err != nil {
+		return nil, ErrQuery(err)
+	}
+
+	var upTo any
+	if limit > 0 {
+		upTo = limit
+	}
+	var rows *sql.Rows
+	// changes are matched by the catalog names of the table and its schema, any schema when none is set
+	tableName := splitName(getStringConfigProperty(d.datasetDefinition.SourceConfig, TableName))
+	table := identifierName(tableName[len(tableName)-1])
+	schema := d.schema()
+	if len(tableName) > 1 {
+		schema = tableName[0]
+	}
+	schema = identifierName(schema)
+	var decoder changeDecoder
+	if plugin == Wal2JsonPlugin {
+		tables := "*." + table
+		if schema != "" {
+			tables = schema + "." + table
+		}
+		rows, err = db.QueryContext(ctx,
+			"SELECT lsn::text, data FROM pg_logical_slot_peek_changes($1, NULL, $2, 'format-version', '2', 'add-tables', $3)",
+			slot, upTo, tables)
+		decoder = &wal2jsonDecoder{}
+	} else {
+		rows, err = db.QueryContext(ctx,
+			"SELECT lsn::text, data FROM pg_logical_slot_peek_binary_changes($1, NULL, $2, 'proto_version', '1', 'publication_names', $3)",
+			slot, upTo, publication)
+		decoder = &pgoutputDecoder{schema: schema, table: table, relations: map[uint32]*pgRelation{}}
+	}
+	if err != nil {
+		d.logger.Error("failed to read replication slot", "error", err, "slot", slot)
+		return nil, ErrQuery(err)
+	}
+
+	deletedCol, deletedVal := deletedMarker(d.datasetDefinition)
+	started = true
+	return &cdcIterator{
+		logger:     d.logger,
+		cancel:     cancel,
+		mapper:     mapper,
+		rows:       rows,
+		decoder:    decoder,
+		lsn:        sinceLSN,
+		deletedCol: deletedCol,
+		deletedVal: deletedVal,
+		references: referenceColumns(d.datasetDefinition),
+	}, nil
+}
+
+// buildSnapshotQuery returns the query of the table contents. With a limit the rows are ordered
+// by identity, starting after the identity in the from token.
+func buildSnapshotQuery(definition *cdl.DatasetDefinition, schema string, from string, limit int) (string, []any, error) {
+	q, args, err := buildQuery(definition, schema, "", "", "", 0, false)
+	if err != nil || limit == 0 {
+		return q, args, err
+	}
+	return pagedByKey(q, args, identityColumn(definition), from, limit)
+}
+
+// decodeSnapshotToken returns the WAL position and the last identity of a full snapshot page,
+// and false for other tokens
+func decodeSnapshotToken(token string) (*sinceToken, bool) {
+	st, err := decodeEntitiesToken(token)
+	if err != nil || st.Until == "" || st.After == "" {
+		return nil, false
+	}
+	return st, true
+}
+
+// checkReplicaIdentity fails unless the table has REPLICA IDENTITY FULL. Updates of other
+// tables leave out the values of unchanged TOAST columns, and deletes all but the key.
+func checkReplicaIdentity(ctx context.Context, db *sql.DB, table string) error {
+	var identity string
+	err := db.QueryRowContext(ctx, "SELECT relreplident::text FROM pg_class WHERE oid = to_regclass($1)", table).Scan(&identity)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("table %s not found", table)
+	}
+	if err != nil {
+		return err
+	}
+	if identity != "f" {
+		return fmt.Errorf("table %s must have REPLICA IDENTITY FULL for change data capture, run ALTER TABLE %s REPLICA IDENTITY FULL", table, table)
+	}
+	return nil
+}
+
+// ensureReplicationSlot creates the slot if it does not exist and returns its confirmed position
+func ensureReplicationSlot(ctx context.Context, db *sql.DB, slot string, plugin string) (string, error) {
+	var confirmed sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT confirmed_flush_lsn::text FROM pg_replication_slots WHERE slot_name = $1", slot).Scan(&confirmed)
+	if err == sql.ErrNoRows {
+		err = db.QueryRowContext(ctx, "SELECT lsn::text FROM pg_create_logical_replication_slot($1, $2)", slot, plugin).Scan(&confirmed)
+	}
+	if err != nil {
+		return "", err
+	}
+	return confirmed.String, nil
+}
+
+// advanceReplicationSlot moves the confirmed position of the slot forward to lsn
+func advanceReplicationSlot(ctx context.Context, db *sql.DB, slot string, lsn string, confirmed string) error {
+	if !lsnLess(confirmed, lsn) {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "SELECT pg_replication_slot_advance($1, $2::pg_lsn)", slot, lsn)
+	return err
+}
+
+func encodeLSNToken(lsn string) string {
+	return base64.URLEncoding.EncodeToString([]byte(lsn))
+}
+
+func decodeLSNToken(token string) (string, error) {
+	b, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+	lsn := string(b)
+	if _, err = parseLSN(lsn); err != nil {
+		return "", err
+	}
+	return lsn, nil
+}
+
+// parseLSN parses the textual X/Y representation of a WAL position
+func parseLSN(lsn string) (uint64, error) {
+	hi, lo, found := strings.Cut(lsn, "/")
+	if !found {
+		return 0, fmt.Errorf("invalid lsn %q", lsn)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lsn %q: %w", lsn, err)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lsn %q: %w", lsn, err)
+	}
+	return h<<32 | l, nil
+}
+
+// lsnLess reports whether a is before b, positions that cannot be parsed sort first
+func lsnLess(a string, b string) bool {
+	la, _ := parseLSN(a)
+	lb, _ := parseLSN(b)
+	return la < lb
+}
+
+// rowChange is a decoded insert, update or delete. Deletes only carry the replica identity columns.
+type rowChange struct {
+	deleted bool
+	columns []string
+	values  map[string]any
+}
+
+// value returns the value of a column of the change, if it has one
+func (c *rowChange) value(col string) (any, bool) {
+	if c == nil {
+		return nil, false
+	}
+	v, found := c.values[col]
+	return v, found
+}
+
+type changeDecoder interface {
+	// decode handles one message returned from the slot. It returns the row change if the
+	// message contained one, and whether the message ended a transaction.
+	decode(data []byte) (change *rowChange, commit bool, err error)
+}
+
+type cdcIterator struct {
+	logger  cdl.Logger
+	mapper  *cdl.Mapper
+	rows    *sql.Rows
+	cancel  context.CancelFunc
+	decoder changeDecoder
+	lsn     string
+	// deletedCol and deletedVal mark updated rows as soft deleted, see dbIterator
+	deletedCol string
+	deletedVal string
+	references map[string]bool
+}
+
+func (it *cdcIterator) Context() *egdm.Context {
+	ctx := egdm.NewNamespaceContext()
+	return ctx.AsContext()
+}
+
+func (it *cdcIterator) Next() (*egdm.Entity, cdl.LayerError) {
+	for it.rows.Next() {
+		var lsn string
+		var data []byte
+		err := it.rows.Scan(&lsn, &data)
+		if err != nil {
+			it.logger.Error("failed to scan change", "error", err)
+			return nil, cdl.Err(err, cdl.LayerErrorInternal)
+		}
+
+		change, commit, err := it.decoder.decode(data)
+		if err != nil {
+			it.logger.Error("failed to decode change", "error", err, "lsn", lsn)
+			return nil, cdl.Err(err, cdl.LayerErrorInternal)
+		}
+		if commit {
+			// the slot only returns complete transactions, so every commit is a safe restart point
+			it.lsn = lsn
+		}
+		if change == nil {
+			continue
+		}
+
+		ri := &RowItem{Columns: change.columns, Map: change.values, references: it.references}
+		entity := egdm.NewEntity()
+		err = it.mapper.MapItemToEntity(ri, entity)
+		if err != nil {
+			it.logger.Error("failed to map change", "error", err, "row", fmt.Sprintf("%+v", ri))
+			return nil, cdl.Err(err, cdl.LayerErrorInternal)
+		}
+		if change.deleted || (it.deletedCol != "" && isDeletedValue(change.values[it.deletedCol], it.deletedVal)) {
+			entity.IsDeleted = true
+		}
+		return entity, nil
+	}
+
+	if it.rows.Err() != nil {
+		it.logger.Error("failed to read changes", "error", it.rows.Err())
+		return nil, cdl.Err(it.rows.Err(), cdl.LayerErrorInternal)
+	}
+	return nil, nil
+}
+
+func (it *cdcIterator) Token() (*egdm.Continuation, cdl.LayerError) {
+	cont := egdm.NewContinuation()
+	cont.Token = encodeLSNToken(it.lsn)
+	return cont, nil
+}
+
+func (it *cdcIterator) Close() cdl.LayerError {
+	err := it.rows.Close()
+	if it.cancel != nil {
+		it.cancel()
+	}
+	if err != nil {
+		return cdl.Err(err, cdl.LayerErrorInternal)
+	}
+	return nil
+}
+
+// wal2jsonDecoder decodes the output of wal2json with format-version 2, one change per message
+type wal2jsonDecoder struct{}
+
+type wal2jsonColumn struct {
+	Name  string          `json:"name"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+type wal2jsonMessage struct {
+	Action   string           `json:"action"`
+	Columns  []wal2jsonColumn `json:"columns"`
+	Identity []wal2jsonColumn `json:"identity"`
+}
+
+func (w *wal2jsonDecoder) decode(data []byte) (*rowChange, bool, error) {
+	msg := &wal2jsonMessage{}
+	err := json.Unmarshal(data, msg)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var cols []wal2jsonColumn
+	change := &rowChange{values: map[string]any{}}
+	switch msg.Action {
+	case "C":
+		return nil, true, nil
+	case "I":
+		cols = msg.Columns
+	case "U":
+		// unchanged TOAST values are left out of the columns, they are taken from the old row
+		// that tables with REPLICA IDENTITY FULL send as identity
+		cols = msg.Columns
+		for _, col := range msg.Identity {
+			if !slices.ContainsFunc(cols, func(c wal2jsonColumn) bool { return c.Name == col.Name }) {
+				cols = append(cols, col)
+			}
+		}
+	case "D":
+		cols = msg.Identity
+		change.deleted = true
+	default:
+		return nil, false, nil
+	}
+
+	for _, col := range cols {
+		dec := json.NewDecoder(strings.NewReader(string(col.Value)))
+		dec.UseNumber()
+		var v any
+		err = dec.Decode(&v)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decode value of column %s: %w", col.Name, err)
+		}
+		if n, ok := v.(json.Number); ok {
+			v = numberValue(n)
+		}
+		if s, ok := v.(string); ok && strings.HasSuffix(col.Type, "[]") {
+			v, err = parseArray(s, wal2jsonElemType(strings.TrimSuffix(col.Type, "[]")))
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to decode value of column %s: %w", col.Name, err)
+			}
+		}
+		name := strings.ToLower(col.Name)
+		change.columns = append(change.columns, name)
+		change.values[name] = v
+	}
+	return change, false, nil
+}
+
+// wal2jsonElemType returns the element type name used by parseArray for a wal2json type name
+func wal2jsonElemType(typ string) string {
+	switch typ {
+	case "smallint", "integer", "bigint":
+		return "INT8"
+	case "real", "double precision":
+		return "FLOAT8"
+	case "boolean":
+		return "BOOL"
+	case "json", "jsonb":
+		return "JSONB"
+	}
+	if strings.HasPrefix(typ, "numeric") {
+		return "NUMERIC"
+	}
+	return "TEXT"
+}
+
+// numberValue keeps whole numbers as integers so identities are not rendered as floats
+func numberValue(n json.Number) any {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	if f, err := n.Float64(); err == nil {
+		return f
+	}
+	return n.String()
+}
+
+// pgoutputDecoder decodes the binary pgoutput protocol (version 1). Relation messages are
+// sent before the first change of a relation in each decoding session and are cached here.
+// Changes to other tables than the dataset table are skipped.
+type pgoutputDecoder struct {
+	// schema is empty to match the table in any schema
+	schema    string
+	table     string
+	relations map[uint32]*pgRelation
+}
+
+type pgRelation struct {
+	namespace string
+	name      string
+	columns   []string
+	types     []uint32
+}
+
+func (p *pgoutputDecoder) decode(data []byte) (*rowChange, bool, error) {
+	if len(data) == 0 {
+		return nil, false, nil
+	}
+	r := &pgReader{buf: data[1:]}
+	switch data[0] {
+	case 'C':
+		return nil, true, nil
+	case 'R':
+		id := r.uint32()
+		rel := &pgRelation{namespace: r.string()}
+		rel.name = r.string()
+		r.byte() // replica identity setting
+		n := int(r.uint16())
+		for i := 0; i < n; i++ {
+			r.byte() // flags
+			rel.columns = append(rel.columns, strings.ToLower(r.string()))
+			rel.types = append(rel.types, r.uint32())
+			r.uint32() // type modifier
+		}
+		if r.err != nil {
+			return nil, false, r.err
+		}
+		p.relations[id] = rel
+		return nil, false, nil
+	case 'I', 'U', 'D':
+		rel, found := p.relations[r.uint32()]
+		if !found {
+			return nil, false, fmt.Errorf("change for unknown relation")
+		}
+		if rel.name != p.table || (p.schema != "" && rel.namespace != p.schema) {
+			return nil, false, nil
+		}
+		kind := r.byte()
+		var old *rowChange
+		if data[0] == 'U' && (kind == 'K' || kind == 'O') {
+			// the old key or row of an update, the new tuple follows. Only the old row of a
+			// table with REPLICA IDENTITY FULL holds the values of the other columns.
+			old = p.tuple(r, rel, nil)
+			if kind == 'K' {
+				old = nil
+			}
+			kind = r.byte()
+		}
+		change := p.tuple(r, rel, old)
+		if r.err != nil {
+			return nil, false, r.err
+		}
+		change.deleted = data[0] == 'D'
+		return change, false, nil
+	default:
+		// begin, origin, type, truncate and logical messages carry no row changes
+		return nil, false, nil
+	}
+}
+
+// tuple reads the columns of a row. Unchanged TOAST values are not sent by the server, they are
+// taken from the old row, and are an error without one, so that no partial entities are returned.
+func (p *pgoutputDecoder) tuple(r *pgReader, rel *pgRelation, old *rowChange) *rowChange {
+	change := &rowChange{values: map[string]any{}}
+	n := int(r.uint16())
+	for i := 0; i < n && r.err == nil; i++ {
+		kind := r.byte()
+		if i >= len(rel.columns) {
+			r.err = fmt.Errorf("tuple has more columns than relation %s", rel.name)
+			break
+		}
+		switch kind {
+		case 'n':
+			change.columns = append(change.columns, rel.columns[i])
+			change.values[rel.columns[i]] = nil
+		case 't':
+			l := int(r.uint32())
+			change.columns = append(change.columns, rel.columns[i])
+			change.values[rel.columns[i]] = pgTextValue(string(r.bytes(l)), rel.types[i])
+		case 'u':
+			v, found := old.value(rel.columns[i])
+			if !found {
+				r.err = fmt.Errorf("unchanged TOAST value of column %s in update of %s, the table must have REPLICA IDENTITY FULL", rel.columns[i], rel.name)
+				break
+			}
+			change.columns = append(change.columns, rel.columns[i])
+			change.values[rel.columns[i]] = v
+		default:
+			r.err = fmt.Errorf("unknown tuple data kind %q", kind)
+		}
+	}
+	return change
+}
+
+// pgTextValue converts the text representation of common scalar types to native values
+func pgTextValue(s string, oid uint32) any {
+	switch oid {
+	case 16: // bool
+		return s == "t"
+	case 20, 21, 23: // int8, int2, int4
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+	case 700, 701: // float4, float8
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case 1700: // numeric
+		return json.Number(s)
+	case 114, 3802: // json, jsonb
+		return json.RawMessage(s)
+	}
+	if elemType, ok := pgArrayElemTypes[oid]; ok {
+		if list, err := parseArray(s, elemType); err == nil {
+			return list
+		}
+	}
+	return s
+}
+
+// pgArrayElemTypes holds the element type names used by parseArray for the built-in array types
+var pgArrayElemTypes = map[uint32]string{
+	1000: "BOOL",
+	1005: "INT2",
+	1007: "INT4",
+	1016: "INT8",
+	1021: "FLOAT4",
+	1022: "FLOAT8",
+	1231: "NUMERIC",
+	199:  "JSON",
+	3807: "JSONB",
+	1009: "TEXT",
+	1014: "BPCHAR",
+	1015: "VARCHAR",
+	2951: "UUID",
+	1041: "INET",
+	1182: "DATE",
+	1115: "TIMESTAMP",
+	1185: "TIMESTAMPTZ",
+}
+
+type pgReader struct {
+	buf []byte
+	err error
+}
+
+func (r *pgReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.buf) < n {
+		r.err = fmt.Errorf("unexpected end of pgoutput message")
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *pgReader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *pgReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *pgReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *pgReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	i := strings.IndexByte(string(r.buf), 0)
+	if i < 0 {
+		r.err = fmt.Errorf("unterminated string in pgoutput message")
+		return ""
+	}
+	s := string(r.buf[:i])
+	r.buf = r.buf[i+1:]
+	return s
+}
@@ -0,0 +1,237 @@
+package layer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// pgoutputMessage builds binary pgoutput messages the way the server sends them
+type pgoutputMessage struct {
+	bytes.Buffer
+}
+
+func (m *pgoutputMessage) u16(v uint16) *pgoutputMessage {
+	binary.Write(m, binary.BigEndian, v)
+	return m
+}
+
+func (m *pgoutputMessage) u32(v uint32) *pgoutputMessage {
+	binary.Write(m, binary.BigEndian, v)
+	return m
+}
+
+func (m *pgoutputMessage) str(s string) *pgoutputMessage {
+	m.WriteString(s)
+	m.WriteByte(0)
+	return m
+}
+
+func (m *pgoutputMessage) text(s string) *pgoutputMessage {
+	m.WriteByte('t')
+	m.u32(uint32(len(s)))
+	m.WriteString(s)
+	return m
+}
+
+func relationMessage(id uint32, table string) []byte {
+	m := &pgoutputMessage{}
+	m.WriteByte('R')
+	m.u32(id).str("public").str(table)
+	m.WriteByte('d')
+	m.u16(3)
+	m.WriteByte(1)
+	m.str("Id").u32(23).u32(0xffffffff)
+	m.WriteByte(0)
+	m.str("name").u32(25).u32(0xffffffff)
+	m.WriteByte(0)
+	m.str("active").u32(16).u32(0xffffffff)
+	return m.Bytes()
+}
+
+func TestPgoutputDecoder(t *testing.T) {
+	dec := &pgoutputDecoder{table: "product", relations: map[uint32]*pgRelation{}}
+
+	decode := func(data []byte) (*rowChange, bool) {
+		t.Helper()
+		change, commit, err := dec.decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return change, commit
+	}
+
+	if change, _ := decode(relationMessage(1, "product")); change != nil {
+		t.Fatal("relation message must not produce a change")
+	}
+	decode(relationMessage(2, "other"))
+
+	insert := &pgoutputMessage{}
+	insert.WriteByte('I')
+	insert.u32(1)
+	insert.WriteByte('N')
+	insert.u16(3).text("7").text("widget")
+	insert.WriteByte('n')
+	change, _ := decode(insert.Bytes())
+	expected := &rowChange{
+		columns: []string{"id", "name", "active"},
+		values:  map[string]any{"id": int64(7), "name": "widget", "active": nil},
+	}
+	if !reflect.DeepEqual(change, expected) {
+		t.Errorf("unexpected insert change: %+v", change)
+	}
+
+	// unchanged TOAST values are taken from the old row of a table with REPLICA IDENTITY FULL
+	update := &pgoutputMessage{}
+	update.WriteByte('U')
+	update.u32(1)
+	update.WriteByte('O')
+	update.u16(3).text("6").text("gadget").text("f")
+	update.WriteByte('N')
+	update.u16(3).text("7")
+	update.WriteByte('u')
+	update.text("t")
+	change, _ = decode(update.Bytes())
+	expected = &rowChange{
+		columns: []string{"id", "name", "active"},
+		values:  map[string]any{"id": int64(7), "name": "gadget", "active": true},
+	}
+	if !reflect.DeepEqual(change, expected) {
+		t.Errorf("unexpected update change: %+v", change)
+	}
+
+	// without the old row the update is not returned with the value missing
+	update = &pgoutputMessage{}
+	update.WriteByte('U')
+	update.u32(1)
+	update.WriteByte('K')
+	update.u16(3).text("6")
+	update.WriteByte('n')
+	update.WriteByte('n')
+	update.WriteByte('N')
+	update.u16(3).text("7")
+	update.WriteByte('u')
+	update.text("t")
+	if _, _, err := dec.decode(update.Bytes()); err == nil || !strings.Contains(err.Error(), "REPLICA IDENTITY FULL") {
+		t.Errorf("expected an error for an unchanged TOAST value without the old row, got %v", err)
+	}
+
+	del := &pgoutputMessage{}
+	del.WriteByte('D')
+	del.u32(1)
+	del.WriteByte('K')
+	del.u16(3).text("7")
+	del.WriteByte('n')
+	del.WriteByte('n')
+	change, _ = decode(del.Bytes())
+	if change == nil || !change.deleted || change.values["id"] != int64(7) {
+		t.Errorf("unexpected delete change: %+v", change)
+	}
+
+	other := &pgoutputMessage{}
+	other.WriteByte('I')
+	other.u32(2)
+	other.WriteByte('N')
+	other.u16(1).text("1")
+	if change, _ = decode(other.Bytes()); change != nil {
+		t.Errorf("expected change to other table to be skipped, got %+v", change)
+	}
+
+	if _, commit := decode([]byte{'C', 0}); !commit {
+		t.Error("expected commit message to end the transaction")
+	}
+
+	if _, _, err := dec.decode([]byte{'I', 0, 0}); err == nil {
+		t.Error("expected error for truncated message")
+	}
+}
+
+func TestWal2jsonDecoder(t *testing.T) {
+	dec := &wal2jsonDecoder{}
+
+	change, commit, err := dec.decode([]byte(`{"action":"I","schema":"public","table":"product","columns":[{"name":"id","type":"integer","value":1},{"name":"price","type":"numeric","value":1.5},{"name":"name","type":"text","value":"a"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &rowChange{
+		columns: []string{"id", "price", "name"},
+		values:  map[string]any{"id": int64(1), "price": 1.5, "name": "a"},
+	}
+	if commit || !reflect.DeepEqual(change, expected) {
+		t.Errorf("unexpected insert change: %+v", change)
+	}
+
+	change, _, err = dec.decode([]byte(`{"action":"U","schema":"public","table":"product","columns":[{"name":"id","type":"integer","value":1},{"name":"related","type":"integer[]","value":"{2,3}"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(change.values["related"], []any{int64(2), int64(3)}) {
+		t.Errorf("unexpected array value: %#v", change.values["related"])
+	}
+
+	change, _, err = dec.decode([]byte(`{"action":"U","schema":"public","table":"product","columns":[{"name":"id","type":"integer","value":1}],"identity":[{"name":"id","type":"integer","value":1},{"name":"notes","type":"text","value":"long"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.values["notes"] != "long" {
+		t.Errorf("expected the unchanged TOAST value from the old row, got %+v", change)
+	}
+
+	change, _, err = dec.decode([]byte(`{"action":"D","schema":"public","table":"product","identity":[{"name":"id","type":"integer","value":1}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !change.deleted || change.values["id"] != int64(1) {
+		t.Errorf("unexpected delete change: %+v", change)
+	}
+
+	change, commit, err = dec.decode([]byte(`{"action":"C"}`))
+	if err != nil || change != nil || !commit {
+		t.Errorf("expected commit, got %+v %v %v", change, commit, err)
+	}
+}
+
+func TestLSNTokens(t *testing.T) {
+	lsn, err := decodeLSNToken(encodeLSNToken("16/B374D848"))
+	if err != nil || lsn != "16/B374D848" {
+		t.Fatalf("unexpected lsn %s: %v", lsn, err)
+	}
+	if _, err = decodeLSNToken(encodeLSNToken("0/1'; DROP")); err == nil {
+		t.Error("expected invalid lsn to be rejected")
+	}
+	if !lsnLess("0/FFFFFFFF", "1/0") || lsnLess("1/10", "1/9") {
+		t.Error("unexpected lsn ordering")
+	}
+}
+
+func TestSnapshotPages(t *testing.T) {
+	def := testDefinition(map[string]any{TableName: "product", CdcSlot: "products"})
+	q, args, err := buildSnapshotQuery(def, "", "", 0)
+	if err != nil || q != `SELECT "id", "name" FROM "product"` || len(args) != 0 {
+		t.Errorf("unexpected snapshot query %s %v %v", q, args, err)
+	}
+
+	// a full page continues after its last row within the snapshot
+	it := &dbIterator{tokenColumn: "id", limit: 2, rowsRead: 2, lastKey: "42", snapshotSince: "0/16B3748", endToken: encodeLSNToken("0/16B3748")}
+	st, ok := decodeSnapshotToken(it.keyToken())
+	if !ok || st.Until != "0/16B3748" || st.After != "42" {
+		t.Fatalf("expected a snapshot page token, got %+v", st)
+	}
+	q, args, err = buildSnapshotQuery(def, "", base64.URLEncoding.EncodeToString([]byte(st.After)), 2)
+	expected := `SELECT * FROM (SELECT "id", "name" FROM "product") AS entities WHERE "id" > $1 ORDER BY "id" LIMIT $2`
+	if err != nil || q != expected || !reflect.DeepEqual(args, []any{"42", 2}) {
+		t.Errorf("unexpected snapshot page query %s %v %v", q, args, err)
+	}
+
+	// the last page returns the position of the snapshot
+	it.rowsRead = 1
+	if lsn, err := decodeLSNToken(it.keyToken()); err != nil || lsn != "0/16B3748" {
+		t.Errorf("expected the lsn token of the snapshot, got %s %v", lsn, err)
+	}
+	if _, ok := decodeSnapshotToken(encodeLSNToken("0/16B3748")); ok {
+		t.Error("expected an lsn token not to continue the snapshot")
+	}
+}
@@ -2,20 +2,67 @@ package layer
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	cdl "github.com/mimiro-io/common-datalayer"
+	"maps"
+	"math"
+	"net"
+	"net/url"
+	"reflect"
+	"slices"
 	"strings"
 )
 
 const (
-	TableName      = "table_name"
-	FlushThreshold = "flush_threshold"
-	AppendMode     = "append_mode"
-	SinceColumn    = "since_column"
-	EntityColumn   = "entity_column"
-	SinceTable     = "since_table"
-	SinceDatatype  = "since_datatype"
-	DataQuery      = "data_query"
+	TableName        = "table_name"
+	FlushThreshold   = "flush_threshold"
+	AppendMode       = "append_mode"
+	SinceColumn      = "since_column"
+	EntityColumn     = "entity_column"
+	SinceTable       = "since_table"
+	SinceDatatype    = "since_datatype"
+	DataQuery        = "data_query"
+	TiebreakerColumn = "tiebreaker_column"
+	UpsertMode       = "upsert_mode"
+	WriteStrategy    = "write_strategy"
+	CdcSlot          = "cdc_slot"
+	CdcPublication   = "cdc_publication"
+	CdcPlugin        = "cdc_plugin"
+
+	ChangeLog            = "change_log"
+	ChangeLogIdColumn    = "change_log_id_column"
+	ChangeLogOrderColumn = "change_log_order_column"
+
+	DeletedColumn     = "deleted_column"
+	DeletedValue      = "deleted_value"
+	DeletedExpression = "deleted_expression"
+	SoftDelete        = "soft_delete"
+
+	TombstoneTable = "tombstone_table"
+	Relations      = "relations"
+	AutoCreate     = "auto_create"
+	Schema         = "schema"
+	Connection     = "connection"
+
+	// read replicas in the system config, or the connection of a dataset
+	ReadReplicas  = "read_replicas"
+	MaxReplicaLag = "max_replica_lag"
+
+	// timeouts and pool settings, in the system config and, except for the pool, in the source config
+	StatementTimeout         = "statement_timeout"
+	IdleInTransactionTimeout = "idle_in_transaction_session_timeout"
+	ReadTimeout              = "read_timeout"
+	ConnectionMaxLifetime    = "connection_max_lifetime"
+	ConnectionMaxIdleTime    = "connection_max_idle_time"
+	MaxOpenConnections       = "max_open_connections"
+	MaxIdleConnections       = "max_idle_connections"
+)
+
+// write strategies
+const (
+	InsertStrategy = "insert"
+	CopyStrategy   = "copy"
 )
 
 type PgsqlConf struct {
@@ -25,11 +72,286 @@ type PgsqlConf struct {
 	User     string `json:"user"`
 	Password string `json:"password"`
 	Schema   string `json:"schema"`
+
+	// connection options, see dsn
+	SSLMode         string            `json:"sslmode"`
+	SSLRootCert     string            `json:"sslrootcert"`
+	SSLCert         string            `json:"sslcert"`
+	SSLKey          string            `json:"sslkey"`
+	ApplicationName string            `json:"application_name"`
+	ConnectTimeout  json.Number       `json:"connect_timeout"`
+	RuntimeParams   map[string]string `json:"runtime_params"`
+	// ConnectionString replaces all other connection settings when given
+	ConnectionString string `json:"connection_string"`
+
+	// pool limits and timeouts, durations are written as "30s" or "5m"
+	MaxOpenConnections       poolLimit `json:"max_open_connections"`
+	MaxIdleConnections       poolLimit `json:"max_idle_connections"`
+	ConnectionMaxLifetime    string    `json:"connection_max_lifetime"`
+	ConnectionMaxIdleTime    string    `json:"connection_max_idle_time"`
+	StatementTimeout         string    `json:"statement_timeout"`
+	IdleInTransactionTimeout string    `json:"idle_in_transaction_session_timeout"`
+	ReadTimeout              string    `json:"read_timeout"`
+
+	// ReadReplicas are the servers changes and entities are read from, see readPool
+	ReadReplicas  replicaSettings `json:"read_replicas"`
+	MaxReplicaLag string          `json:"max_replica_lag"`
+}
+
+// dsn returns the connection string of the configuration. sslmode defaults to disable,
+// runtime params are sent to the server as session settings.
+func (c *PgsqlConf) dsn() string {
+	if c.ConnectionString != "" {
+		return c.ConnectionString
+	}
+
+	q := url.Values{}
+	sslMode := c.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	q.Set("sslmode", sslMode)
+	for key, val := range map[string]string{
+		"sslrootcert":      c.SSLRootCert,
+		"sslcert":          c.SSLCert,
+		"sslkey":           c.SSLKey,
+		"application_name": c.ApplicationName,
+		"connect_timeout":  c.ConnectTimeout.String(),
+	} {
+		if val != "" {
+			q.Set(key, val)
+		}
+	}
+	for key, val := range c.RuntimeParams {
+		q.Set(key, val)
+	}
+
+	host := c.Hostname
+	if c.Port != "" {
+		host = net.JoinHostPort(c.Hostname, c.Port)
+	}
+	u := &url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     host,
+		Path:     "/" + c.Database,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// the settings of the source config by kind, see validateConfig
+var (
+	stringSettings = []string{
+		TableName, SinceColumn, EntityColumn, SinceTable, SinceDatatype, DataQuery, TiebreakerColumn, WriteStrategy,
+		CdcSlot, CdcPublication, CdcPlugin, ChangeLogIdColumn, ChangeLogOrderColumn, DeletedColumn, DeletedExpression,
+		TombstoneTable, Schema, StatementTimeout, IdleInTransactionTimeout, ReadTimeout,
+	}
+	booleanSettings = []string{AppendMode, UpsertMode, ChangeLog, SoftDelete, AutoCreate}
+	otherSettings   = []string{FlushThreshold, DeletedValue, Relations, Connection}
+	sinceDatatypes  = []string{"time", "int", "float", "string"}
+)
+
+// validateConfig checks the system config and the source config of every dataset. It returns
+// all problems found, each with the dataset it is found in.
+func validateConfig(config *cdl.Config) error {
+	var errs []error
+	if err := validateConnection(config.NativeSystemConfig); err != nil {
+		errs = append(errs, fmt.Errorf("system_config: %w", err))
+	}
+	seen := map[string]bool{}
+	for i, dsd := range config.DatasetDefinitions {
+		if dsd == nil || dsd.DatasetName == "" {
+			errs = append(errs, fmt.Errorf("dataset definition %d: name is missing", i+1))
+			continue
+		}
+		if seen[dsd.DatasetName] {
+			errs = append(errs, fmt.Errorf("dataset %s: defined more than once", dsd.DatasetName))
+		}
+		seen[dsd.DatasetName] = true
+		for _, problem := range validateSourceConfig(dsd, config.NativeSystemConfig) {
+			errs = append(errs, fmt.Errorf("dataset %s: %s", dsd.DatasetName, problem))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateSourceConfig(definition *cdl.DatasetDefinition, system map[string]any) []string {
+	sc := definition.SourceConfig
+	if sc == nil {
+		return []string{"source_config is missing"}
+	}
+	var problems []string
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	for _, key := range stringSettings {
+		if v, ok := sc[key]; ok && v != nil {
+			if _, ok := v.(string); !ok {
+				add("%s must be a string", key)
+			}
+		}
+	}
+	for _, key := range booleanSettings {
+		if v, ok := sc[key]; ok && v != nil {
+			if _, ok := v.(bool); !ok {
+				add("%s must be true or false", key)
+			}
+		}
+	}
+	has := func(key string) bool {
+		return getStringConfigProperty(sc, key) != ""
+	}
+
+	if !has(TableName) && !has(DataQuery) {
+		add("table_name or data_query is required")
+	}
+	if v, ok := sc[FlushThreshold]; ok {
+		if f, ok := v.(float64); !ok || f < 1 || f != math.Trunc(f) {
+			add("flush_threshold must be a positive integer")
+		}
+	}
+	if dt := getStringConfigProperty(sc, SinceDatatype); dt != "" && !slices.Contains(sinceDatatypes, dt) {
+		add("since_datatype must be one of %s, got %q", strings.Join(sinceDatatypes, ", "), dt)
+	}
+	if has(SinceTable) && !has(SinceColumn) {
+		add("since_table requires since_column")
+	}
+	if has(SinceColumn) && !has(SinceTable) && !has(TableName) {
+		add("since_column with data_query requires since_table")
+	}
+	if ws := getStringConfigProperty(sc, WriteStrategy); ws != "" && ws != InsertStrategy && ws != CopyStrategy {
+		add("write_strategy must be %s or %s, got %q", InsertStrategy, CopyStrategy, ws)
+	}
+	if has(CdcSlot) {
+		plugin := getStringConfigProperty(sc, CdcPlugin)
+		if plugin == "" {
+			plugin = PgOutputPlugin
+		}
+		if !has(TableName) {
+			add("cdc_slot requires table_name")
+		}
+		if plugin != PgOutputPlugin && plugin != Wal2JsonPlugin {
+			add("cdc_plugin must be %s or %s, got %q", PgOutputPlugin, Wal2JsonPlugin, plugin)
+		} else if plugin == PgOutputPlugin && !has(CdcPublication) {
+			add("cdc_slot requires cdc_publication for plugin %s", PgOutputPlugin)
+		}
+	}
+	if getBooleanConfigProperty(sc, ChangeLog) && !has(ChangeLogOrderColumn) {
+		add("change_log requires change_log_order_column")
+	}
+	if getBooleanConfigProperty(sc, SoftDelete) && !has(DeletedColumn) {
+		add("soft_delete requires deleted_column")
+	}
+	if v, ok := sc[DeletedValue]; ok && v != nil {
+		switch v.(type) {
+		case string, float64, bool:
+		default:
+			add("deleted_value must be a string, number or boolean")
+		}
+	}
+	if has(TombstoneTable) && (!has(TableName) || !has(SinceColumn) || has(DataQuery)) {
+		add("tombstone_table requires table_name and since_column, and no data_query")
+	}
+	if has(TombstoneTable) && getStringConfigProperty(sc, SinceDatatype) != "time" {
+		// the deletion time of a tombstone is read as the since value
+		add("tombstone_table requires since_datatype time")
+	}
+	if getBooleanConfigProperty(sc, AutoCreate) && !has(TableName) {
+		add("auto_create requires table_name")
+	}
+	if _, err := datasetRelations(definition); err != nil {
+		add("%s", err)
+	} else if sc[Relations] != nil && has(DataQuery) {
+		add("relations are not supported with data_query")
+	}
+	if _, err := sessionSettings(sc); err != nil {
+		add("%s", err)
+	}
+	if v := getStringConfigProperty(sc, ReadTimeout); v != "" {
+		if _, err := parseTimeout(ReadTimeout, v); err != nil {
+			add("%s", err)
+		}
+	}
+	if _, ok := sc[Connection]; ok {
+		native, err := datasetConnectionConfig(system, sc)
+		if err == nil {
+			err = validateConnection(native)
+		}
+		if err != nil {
+			add("connection: %s", err)
+		}
+	}
+	return problems
+}
+
+// readWarnings returns the settings missing to read the dataset. They are no problems of the
+// configuration, as a dataset that is only written to needs neither an outgoing mapping nor
+// the since datatype of the since column it stamps.
+func readWarnings(definition *cdl.DatasetDefinition) []string {
+	sc := definition.SourceConfig
+	var warnings []string
+	if definition.OutgoingMappingConfig == nil && getStringConfigProperty(sc, EntityColumn) == "" {
+		warnings = append(warnings, "entities cannot be read without outgoing_mapping_config or entity_column")
+	}
+	if getStringConfigProperty(sc, SinceColumn) != "" && getStringConfigProperty(sc, SinceDatatype) == "" {
+		warnings = append(warnings, "changes cannot be read without since_datatype for since_column")
+	}
+	return warnings
+}
+
+// unknownSettings returns the keys of the source config that are no settings of the layer.
+// They are allowed, as the source config is also the metadata of the dataset.
+func unknownSettings(sourceConfig map[string]any) []string {
+	var unknown []string
+	for key := range sourceConfig {
+		if !slices.Contains(stringSettings, key) && !slices.Contains(booleanSettings, key) && !slices.Contains(otherSettings, key) {
+			unknown = append(unknown, key)
+		}
+	}
+	slices.Sort(unknown)
+	return unknown
+}
+
+// validateConnection checks the connection settings of a native config
+func validateConnection(native map[string]any) error {
+	for _, name := range []string{MaxOpenConnections, MaxIdleConnections} {
+		if v, ok := native[name]; ok {
+			b, _ := json.Marshal(v)
+			var limit poolLimit
+			if err := limit.UnmarshalJSON(b); err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+	c, cerr := pgsqlConfOf(native)
+	if cerr != nil {
+		return cerr
+	}
+	for name, value := range map[string]string{
+		ConnectionMaxLifetime:    c.ConnectionMaxLifetime,
+		ConnectionMaxIdleTime:    c.ConnectionMaxIdleTime,
+		StatementTimeout:         c.StatementTimeout,
+		IdleInTransactionTimeout: c.IdleInTransactionTimeout,
+		ReadTimeout:              c.ReadTimeout,
+		MaxReplicaLag:            c.MaxReplicaLag,
+	} {
+		if value == "" {
+			continue
+		}
+		if _, err := parseTimeout(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func newPgsqlConf(config *cdl.Config) (*PgsqlConf, cdl.LayerError) {
+	return pgsqlConfOf(config.NativeSystemConfig)
+}
+
+func pgsqlConfOf(nativeConfig map[string]any) (*PgsqlConf, cdl.LayerError) {
 	c := &PgsqlConf{}
-	nativeConfig := config.NativeSystemConfig
 	configJson, _ := json.Marshal(nativeConfig)
 	err := json.Unmarshal(configJson, c)
 
@@ -41,55 +363,196 @@ func newPgsqlConf(config *cdl.Config) (*PgsqlConf, cdl.LayerError) {
 }
 
 func (dl *PgsqlDatalayer) UpdateConfiguration(config *cdl.Config) cdl.LayerError {
-	// close connection and create new one
-	err := dl.db.db.Close()
-	if err != nil {
-		return cdl.Err(fmt.Errorf("could not close database connection because %s", err.Error()), cdl.LayerErrorInternal)
+	dl.reload.Lock()
+	defer dl.reload.Unlock()
+
+	// an invalid configuration is rejected as a whole, the layer keeps the previous one
+	if err := validateConfig(config); err != nil {
+		dl.logger.Error("invalid configuration", "error", err)
+		return cdl.Err(fmt.Errorf("invalid configuration: %w", err), cdl.LayerErrorBadParameter)
+	}
+	for _, dsd := range config.DatasetDefinitions {
+		if unknown := unknownSettings(dsd.SourceConfig); len(unknown) > 0 {
+			dl.logger.Warn("unknown source config settings, kept as metadata", "dataset", dsd.DatasetName, "settings", strings.Join(unknown, ","))
+		}
+		for _, warning := range readWarnings(dsd) {
+			dl.logger.Warn(warning, "dataset", dsd.DatasetName)
+		}
 	}
 
-	// update database connection
-	dl.db, err = newPgsqlDB(config)
+	// the new pools and datasets are built on the side and swapped in as a whole, so that a
+	// configuration that fails leaves the layer as it was
+	next, changes, err := dl.newLayerState(config)
 	if err != nil {
-		return cdl.Err(fmt.Errorf("could not create new database connection because %s", err.Error()), cdl.LayerErrorInternal)
-	}
-	existingDatasets := map[string]bool{}
-	// update existing datasets
-	for k, v := range dl.datasets {
-		for _, dsd := range config.DatasetDefinitions {
-			if k == dsd.DatasetName {
-				existingDatasets[k] = true
-				v.datasetDefinition = dsd
-				v.db = dl.db
-			}
+		return err
+	}
+	if changes.empty() {
+		dl.logger.Debug("configuration unchanged")
+		return nil
+	}
+	dl.swapState(next)
+	dl.logger.Info("configuration updated",
+		"reconnected", changes.reconnected,
+		"system_config", strings.Join(changes.system, ","),
+		"added", strings.Join(changes.added, ","),
+		"changed", strings.Join(changes.changed, ","),
+		"removed", strings.Join(changes.removed, ","))
+	return nil
+}
+
+// swapState makes next the configuration of the layer. Reads and writes in flight keep the
+// datasets they started with, the previous pools are closed once they are done.
+func (dl *PgsqlDatalayer) swapState(next *layerState) {
+	previous := dl.state.Swap(next)
+	if previous != nil && previous.pools != next.pools {
+		previous.pools.retire(drainWarning)
+	}
+}
+
+// configChanges tells how a configuration differs from the current one. Only the names of
+// changed system config settings are kept, as their values may be secrets.
+type configChanges struct {
+	reconnected bool
+	system      []string
+	added       []string
+	changed     []string
+	removed     []string
+}
+
+func (c *configChanges) empty() bool {
+	return !c.reconnected && len(c.system)+len(c.added)+len(c.changed)+len(c.removed) == 0
+}
+
+// newLayerState returns the state of the configuration and how it differs from the current
+// state. The current pools are kept when the configuration needs the same connections, and
+// the datasets whose definitions are unchanged are kept with them. Otherwise the pools still
+// needed are carried over to a registry of their own, and only the missing ones connected.
+func (dl *PgsqlDatalayer) newLayerState(config *cdl.Config) (*layerState, *configChanges, cdl.LayerError) {
+	lowerCaseProperties(config.DatasetDefinitions)
+	current := dl.state.Load()
+
+	natives := map[string]map[string]any{}
+	for _, dsd := range config.DatasetDefinitions {
+		native, err := datasetConnectionConfig(config.NativeSystemConfig, dsd.SourceConfig)
+		if err != nil {
+			return nil, nil, cdl.Err(fmt.Errorf("could not create database connection for dataset %s because %s", dsd.DatasetName, err.Error()), cdl.LayerErrorInternal)
 		}
+		natives[dsd.DatasetName] = native
 	}
 
-	// remove deleted datasets
-	for k := range dl.datasets {
-		if _, found := existingDatasets[k]; !found {
-			delete(dl.datasets, k)
+	changes := &configChanges{system: changedSettings(current, config.NativeSystemConfig)}
+	var pools *poolRegistry
+	if current != nil && current.pools.serves(append(slices.Collect(maps.Values(natives)), config.NativeSystemConfig)) {
+		pools = current.pools
+	} else {
+		pools = newPoolRegistry(dl.logger)
+		if current != nil {
+			pools.previous = current.pools
+			defer func() { pools.previous = nil }()
+		}
+	}
+	opened := pools.opened
+	discard := func() {
+		if current == nil || pools != current.pools {
+			_ = pools.close()
 		}
 	}
 
-	// add new datasets
+	system, err := pools.get(config.NativeSystemConfig)
+	if err != nil {
+		discard()
+		return nil, nil, cdl.Err(fmt.Errorf("could not create new database connection because %s", err.Error()), cdl.LayerErrorInternal)
+	}
+	state := &layerState{config: config, system: cloneSettings(config.NativeSystemConfig), pools: pools, db: system, datasets: map[string]*Dataset{}}
 	for _, dsd := range config.DatasetDefinitions {
-		if _, found := existingDatasets[dsd.DatasetName]; !found {
-			dl.datasets[dsd.DatasetName] = &Dataset{
-				logger:            dl.logger,
-				db:                dl.db,
-				datasetDefinition: dsd,
+		var previous *Dataset
+		if current != nil {
+			previous = current.datasets[dsd.DatasetName]
+		}
+		unchanged := previous != nil && reflect.DeepEqual(previous.datasetDefinition, dsd)
+		if unchanged && previous.pools == pools {
+			state.datasets[dsd.DatasetName] = previous
+			continue
+		}
+		db, err := pools.get(natives[dsd.DatasetName])
+		if err != nil {
+			discard()
+			return nil, nil, cdl.Err(fmt.Errorf("could not create database connection for dataset %s because %s", dsd.DatasetName, err.Error()), cdl.LayerErrorInternal)
+		}
+		ds := &Dataset{
+			logger:            dl.logger,
+			db:                db,
+			pools:             pools,
+			layer:             dl,
+			datasetDefinition: dsd,
+		}
+		state.datasets[dsd.DatasetName] = ds
+		if unchanged {
+			continue
+		}
+		if previous == nil {
+			changes.added = append(changes.added, dsd.DatasetName)
+		} else {
+			changes.changed = append(changes.changed, dsd.DatasetName)
+		}
+	}
+	if current != nil {
+		for name := range current.datasets {
+			if _, ok := state.datasets[name]; !ok {
+				changes.removed = append(changes.removed, name)
 			}
 		}
 	}
+	changes.reconnected = pools.opened > opened
+	slices.Sort(changes.added)
+	slices.Sort(changes.changed)
+	slices.Sort(changes.removed)
+	return state, changes, nil
+}
 
-	// convert all column names to uppercase
-	for _, ds := range dl.datasets {
-		if ds.datasetDefinition.OutgoingMappingConfig != nil {
-			for _, pm := range ds.datasetDefinition.OutgoingMappingConfig.PropertyMappings {
-				pm.Property = strings.ToLower(pm.Property)
+// lowerCaseProperties converts the column names of the outgoing mappings to lower case
+func lowerCaseProperties(definitions []*cdl.DatasetDefinition) {
+	for _, dsd := range definitions {
+		if dsd.OutgoingMappingConfig == nil {
+			continue
+		}
+		for _, pm := range dsd.OutgoingMappingConfig.PropertyMappings {
+			// quoted names keep their case, see identifierName. Definitions may be shared with
+			// the previous configuration, so they are only written when changed.
+			if lower := strings.ToLower(pm.Property); !strings.HasPrefix(pm.Property, "\"") && lower != pm.Property {
+				pm.Property = lower
 			}
 		}
 	}
+}
+
+// changedSettings returns the names of the system config settings that differ from those of
+// the current state
+func changedSettings(current *layerState, system map[string]any) []string {
+	if current == nil {
+		return nil
+	}
+	next := cloneSettings(system)
+	var changed []string
+	for key, v := range next {
+		if !reflect.DeepEqual(current.system[key], v) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range current.system {
+		if _, ok := next[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
 
-	return nil
+// cloneSettings returns a deep copy of the settings, so that they can be compared with those
+// of a later configuration even when the caller changes them in place
+func cloneSettings(settings map[string]any) map[string]any {
+	b, _ := json.Marshal(settings)
+	clone := map[string]any{}
+	_ = json.Unmarshal(b, &clone)
+	return clone
 }
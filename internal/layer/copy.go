@@ -0,0 +1,145 @@
+package layer
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+// copyTable is the temporary table batches are copied into before being merged into the
+// target table. It is created for every batch with the copied columns only, without the
+// constraints of the target, and dropped once merged.
+const copyTable = "pgsql_layer_copy"
+
+// copyBatch writes the pending batch with the COPY protocol. Deletes are handled with the
+// same statement as the insert strategy, the live rows are streamed into a temporary table
+// and merged into the target table from there.
+func (o *PgsqlWriter) copyBatch() error {
+	deleteIds, softDeleteIds, rows := o.splitBatch()
+	childDeletes, childInserts := o.childStatements()
+	err := o.exec(append(childDeletes, o.deleteStatements(deleteIds, softDeleteIds)...)...)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return o.exec(childInserts...)
+	}
+
+	columns := batchColumns(rows)
+	quoted := make([]string, len(columns))
+	for i, col := range columns {
+		quoted[i] = quoteIdentifier(col)
+	}
+	colList := strings.Join(quoted, ", ")
+
+	err = o.exec("CREATE TEMP TABLE " + copyTable + " ON COMMIT DROP AS SELECT " + colList + " FROM " + o.table + " WITH NO DATA")
+	if err != nil {
+		return err
+	}
+
+	err = o.copyRows(rows, columns, "COPY "+copyTable+" ("+colList+") FROM STDIN WITH (FORMAT csv)")
+	if err != nil {
+		return o.rollback(err)
+	}
+
+	merge := "INSERT INTO " + o.table + " (" + colList
+	selectList := colList
+	generated, generatedValues := o.generatedColumns(columns)
+	for i, col := range generated {
+		// columns set to their default are left out, the target fills them as it does for
+		// the insert strategy
+		if generatedValues[i] == "DEFAULT" {
+			continue
+		}
+		merge += ", " + col
+		selectList += ", " + generatedValues[i]
+	}
+	merge += ") SELECT " + selectList + " FROM " + copyTable + o.conflictClause(columns)
+
+	return o.exec(append([]string{merge, "DROP TABLE " + copyTable}, childInserts...)...)
+}
+
+// copyRows streams the rows as CSV through the COPY protocol of the writer connection.
+// Values are sent as text and converted by the server, the same way the literals of the
+// insert strategy are.
+func (o *PgsqlWriter) copyRows(rows []*RowItem, columns []string, stmt string) error {
+	o.logger.Debug(stmt)
+	r, w := io.Pipe()
+	defer r.Close()
+
+	go func() {
+		w.CloseWithError(writeCopyRows(w, rows, columns, o.arrayColumns[o.table]))
+	}()
+
+	return o.conn.Raw(func(driverConn any) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn().PgConn()
+		_, err := pgConn.CopyFrom(o.ctx, r, stmt)
+		return err
+	})
+}
+
+func writeCopyRows(w io.Writer, rows []*RowItem, columns []string, arrays map[string]bool) error {
+	bw := bufio.NewWriter(w)
+	for _, row := range rows {
+		for i, col := range columns {
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			val, err := copyVal(row.Map[col], arrays[identifierName(col)])
+			if err != nil {
+				return err
+			}
+			bw.WriteString(val)
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// copyVal renders a value as a CSV field. NULL is an unquoted empty field, so all other
+// values are quoted to keep empty strings apart from NULL. Lists are written as array
+// literals to array columns, and as JSON to all other columns.
+func copyVal(v any, array bool) (string, error) {
+	if list, ok := v.([]string); ok {
+		v = stringList(list)
+	}
+	var s string
+	switch val := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		s = val
+	case bool:
+		s = strconv.FormatBool(val)
+	case float64:
+		s = strconv.FormatFloat(val, 'f', -1, 64)
+	case int:
+		s = strconv.Itoa(val)
+	case int64:
+		s = strconv.FormatInt(val, 10)
+	case []any:
+		if array {
+			s = arrayLiteral(val)
+			break
+		}
+		b, err := json.Marshal(val)
+		if err != nil {
+			return "", err
+		}
+		s = string(b)
+	case time.Time:
+		s = val.Format(time.RFC3339Nano)
+	default:
+		b, err := json.Marshal(val)
+		if err != nil {
+			return "", err
+		}
+		s = string(b)
+	}
+	return "\"" + strings.ReplaceAll(s, "\"", "\"\"") + "\"", nil
+}
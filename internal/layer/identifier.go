@@ -0,0 +1,82 @@
+package layer
+
+import (
+	"strings"
+)
+
+// Table and column names in the configuration follow the rules of SQL identifiers: they are
+// case insensitive and folded to lower case, unless written in double quotes, as in
+// "\"OrderLines\"". Names are always quoted in the generated statements, so that reserved
+// words can be used as names, and may be qualified with a schema, as in "sales.orders".
+
+// identifierName returns the name of an identifier as stored in the catalog
+func identifierName(name string) string {
+	if len(name) >= 2 && name[0] == '"' && name[len(name)-1] == '"' {
+		return strings.ReplaceAll(name[1:len(name)-1], `""`, `"`)
+	}
+	return strings.ToLower(name)
+}
+
+// quoteIdentifier returns the quoted form of a single identifier
+func quoteIdentifier(name string) string {
+	return quoteExact(identifierName(name))
+}
+
+func quoteExact(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// splitName splits a qualified name at the dots outside of quotes
+func splitName(name string) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '"':
+			quoted = !quoted
+		case '.':
+			if !quoted {
+				parts = append(parts, name[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, name[start:])
+}
+
+// quoteName returns the quoted form of a name that may be qualified
+func quoteName(name string) string {
+	parts := splitName(name)
+	for i, p := range parts {
+		parts[i] = quoteIdentifier(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// tableRef returns the quoted name of a table, qualified with the schema unless the name
+// already is
+func tableRef(schema string, name string) string {
+	if schema == "" || len(splitName(name)) > 1 {
+		return quoteName(name)
+	}
+	return quoteIdentifier(schema) + "." + quoteIdentifier(name)
+}
+
+// unqualifiedName returns the name without its schema
+func unqualifiedName(name string) string {
+	parts := splitName(name)
+	return parts[len(parts)-1]
+}
+
+// suffixName appends the suffix to the unqualified part of a name
+func suffixName(name string, suffix string) string {
+	parts := splitName(name)
+	parts[len(parts)-1] = quoteExact(identifierName(parts[len(parts)-1]) + suffix)
+	return strings.Join(parts, ".")
+}
+
+// columnKey returns the key of a column in the rows read, where column names are lower case
+func columnKey(name string) string {
+	return strings.ToLower(identifierName(name))
+}
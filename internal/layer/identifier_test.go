@@ -0,0 +1,91 @@
+package layer
+
+import (
+	"testing"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+func TestQuoteName(t *testing.T) {
+	tests := []struct {
+		schema string
+		name   string
+		ref    string
+	}{
+		{"", "Product", `"product"`},
+		{"", `"OrderLines"`, `"OrderLines"`},
+		{"", `order`, `"order"`},
+		{"", `sales.orders`, `"sales"."orders"`},
+		{"", `"Sales"."a.b"`, `"Sales"."a.b"`},
+		{"", `"say ""hi"""`, `"say ""hi"""`},
+		{"Sales", "orders", `"sales"."orders"`},
+		{`"Sales"`, "orders", `"Sales"."orders"`},
+		{"sales", "other.orders", `"other"."orders"`},
+	}
+	for _, tt := range tests {
+		if ref := tableRef(tt.schema, tt.name); ref != tt.ref {
+			t.Errorf("expected %s for %s in %s, got %s", tt.ref, tt.name, tt.schema, ref)
+		}
+	}
+
+	if name := fullSyncTable(`sales."Orders"`); tableRef("", name) != `"sales"."Orders_fullsync"` {
+		t.Errorf("unexpected full sync table %s", name)
+	}
+	if key := columnKey(`"FirstName"`); key != "firstname" {
+		t.Errorf("expected lower case key, got %s", key)
+	}
+}
+
+func TestBuildQueryWithSchema(t *testing.T) {
+	def := &cdl.DatasetDefinition{
+		DatasetName: "orders",
+		SourceConfig: map[string]any{
+			TableName:   "order",
+			SinceColumn: `"ModifiedAt"`,
+			Relations: []any{
+				map[string]any{"property": "lines", "table": `"OrderLine"`, "foreign_key": "order_id"},
+			},
+		},
+		OutgoingMappingConfig: &cdl.OutgoingMappingConfig{
+			PropertyMappings: []*cdl.ItemToEntityPropertyMapping{
+				{Property: "id", IsIdentity: true},
+				{Property: `"CustomerName"`},
+				{Property: "user"},
+			},
+		},
+	}
+
+	q, _, err := buildQuery(def, "sales", "", "10", "int", 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `SELECT "id", "CustomerName", "user", "ModifiedAt", ` +
+		`(SELECT json_agg(c) FROM "sales"."OrderLine" c WHERE c."order_id" = "order"."id") AS "lines" FROM "sales"."order" ` +
+		`WHERE "order"."ModifiedAt" <= $1 ORDER BY "order"."ModifiedAt", "order"."id" LIMIT $2`
+	if q != expected {
+		t.Errorf("unexpected query\n got: %s\nwant: %s", q, expected)
+	}
+}
+
+func TestTombstoneDDL(t *testing.T) {
+	expected := `CREATE TABLE IF NOT EXISTS "sales"."Product_tombstone" AS SELECT "id" AS "id", "updated" AS "deleted_at" FROM "sales"."Product" WITH NO DATA;
+CREATE INDEX IF NOT EXISTS "Product_tombstone_deleted_at" ON "sales"."Product_tombstone" ("deleted_at");
+
+CREATE OR REPLACE FUNCTION "sales"."Product_tombstone"() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        DELETE FROM "sales"."Product_tombstone" WHERE "id" = NEW."id";
+        RETURN NEW;
+    END IF;
+    INSERT INTO "sales"."Product_tombstone" ("id", "deleted_at") VALUES (OLD."id", NOW());
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS "Product_tombstone" ON "sales"."Product";
+CREATE TRIGGER "Product_tombstone" AFTER INSERT OR DELETE ON "sales"."Product" FOR EACH ROW EXECUTE FUNCTION "sales"."Product_tombstone"();
+`
+	if ddl := TombstoneDDL(`sales."Product"`, "", "id", "updated"); ddl != expected {
+		t.Errorf("unexpected ddl\n%s", ddl)
+	}
+}
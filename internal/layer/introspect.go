@@ -0,0 +1,253 @@
+package layer
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"strings"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+// sinceColumnNames are the column names taken as since column, in order of preference
+var sinceColumnNames = []string{
+	"updated_at", "modified_at", "last_modified", "last_updated", "changed_at",
+	"updated", "modified", "update_time", "modified_time", "created_at",
+}
+
+// IntrospectedDataset is a dataset definition generated from a table, see Introspect. It only
+// holds the settings that are set, so that it can be written as configuration.
+type IntrospectedDataset struct {
+	Name                  string                     `json:"name"`
+	SourceConfig          map[string]any             `json:"source_config"`
+	IncomingMappingConfig *IntrospectedMappingConfig `json:"incoming_mapping_config"`
+	OutgoingMappingConfig *IntrospectedMappingConfig `json:"outgoing_mapping_config"`
+}
+
+type IntrospectedMappingConfig struct {
+	BaseURI          string                         `json:"base_uri"`
+	PropertyMappings []*IntrospectedPropertyMapping `json:"property_mappings"`
+}
+
+type IntrospectedPropertyMapping struct {
+	EntityProperty       string `json:"entity_property,omitempty"`
+	Property             string `json:"property"`
+	IsIdentity           bool   `json:"is_identity,omitempty"`
+	IsReference          bool   `json:"is_reference,omitempty"`
+	StripReferencePrefix bool   `json:"strip_ref_prefix,omitempty"`
+	URIValuePattern      string `json:"uri_value_pattern,omitempty"`
+}
+
+// tableInfo describes a table as read from information_schema
+type tableInfo struct {
+	schema     string
+	name       string
+	columns    []columnInfo
+	primaryKey []string
+	// foreignKeys holds the referenced table by column, for single column foreign keys
+	foreignKeys map[string]string
+}
+
+type columnInfo struct {
+	name     string
+	dataType string
+}
+
+// Introspect connects with the system config and generates a dataset definition for every
+// table of the schema, or for the given tables only. The schema defaults to the schema of the
+// system config. Entity and property uris are made from the base uri and the table names.
+func Introspect(ctx context.Context, conf *common.Config, schema string, tables []string, baseURI string) ([]*IntrospectedDataset, error) {
+	pg, err := newPgsqlDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	defer pg.db.Close()
+
+	defaultSchema := pg.schema
+	if defaultSchema == "" {
+		defaultSchema = "public"
+	}
+	if schema == "" {
+		schema = defaultSchema
+	}
+	if len(tables) == 0 {
+		tables, err = schemaTables(ctx, pg.db, schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	datasets := make([]*IntrospectedDataset, 0, len(tables))
+	for _, table := range tables {
+		info, err := readTableInfo(ctx, pg.db, schema, table)
+		if err != nil {
+			return nil, err
+		}
+		datasets = append(datasets, introspectedDataset(info, defaultSchema, baseURI))
+	}
+	return datasets, nil
+}
+
+func schemaTables(ctx context.Context, db *sql.DB, schema string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT table_name FROM information_schema.tables
+		WHERE table_schema = $1 AND table_type = 'BASE TABLE' ORDER BY table_name`, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+func readTableInfo(ctx context.Context, db *sql.DB, schema string, table string) (*tableInfo, error) {
+	info := &tableInfo{schema: schema, name: table, foreignKeys: map[string]string{}}
+
+	rows, err := db.QueryContext(ctx, `SELECT column_name, data_type FROM information_schema.columns
+		WHERE table_schema = $1 AND table_name = $2 ORDER BY ordinal_position`, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var c columnInfo
+		if err := rows.Scan(&c.name, &c.dataType); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		info.columns = append(info.columns, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(info.columns) == 0 {
+		return nil, ErrGeneric("table %s.%s not found", schema, table)
+	}
+
+	rows, err = db.QueryContext(ctx, `SELECT tc.constraint_type, tc.constraint_name, kcu.column_name, COALESCE(ccu.table_name, '')
+		FROM information_schema.table_constraints tc
+		JOIN information_schema.key_column_usage kcu
+			ON kcu.constraint_schema = tc.constraint_schema AND kcu.constraint_name = tc.constraint_name
+		LEFT JOIN information_schema.constraint_column_usage ccu
+			ON tc.constraint_type = 'FOREIGN KEY' AND ccu.constraint_schema = tc.constraint_schema AND ccu.constraint_name = tc.constraint_name
+		WHERE tc.table_schema = $1 AND tc.table_name = $2 AND tc.constraint_type IN ('PRIMARY KEY', 'FOREIGN KEY')
+		ORDER BY tc.constraint_name, kcu.ordinal_position`, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	fkColumns := map[string][]string{}
+	fkTables := map[string]string{}
+	for rows.Next() {
+		var constraintType, constraintName, column, referenced string
+		if err := rows.Scan(&constraintType, &constraintName, &column, &referenced); err != nil {
+			return nil, err
+		}
+		if constraintType == "PRIMARY KEY" {
+			info.primaryKey = append(info.primaryKey, column)
+			continue
+		}
+		if !slices.Contains(fkColumns[constraintName], column) {
+			fkColumns[constraintName] = append(fkColumns[constraintName], column)
+		}
+		fkTables[constraintName] = referenced
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// foreign keys over several columns have no single value to make a reference of
+	for name, columns := range fkColumns {
+		if len(columns) == 1 {
+			info.foreignKeys[columns[0]] = fkTables[name]
+		}
+	}
+	return info, nil
+}
+
+// introspectedDataset generates the dataset definition of a table. The primary key becomes the
+// identity when it is a single column, foreign key columns become references to the entities
+// of the referenced table, and a timestamp column with a common name becomes the since column.
+// Tables outside the default schema of the layer are qualified with their schema.
+func introspectedDataset(info *tableInfo, defaultSchema string, baseURI string) *IntrospectedDataset {
+	if baseURI != "" && !strings.HasSuffix(baseURI, "/") && !strings.HasSuffix(baseURI, "#") {
+		baseURI += "/"
+	}
+	tableName := configName(info.name)
+	if info.schema != "" && info.schema != defaultSchema {
+		tableName = configName(info.schema) + "." + tableName
+	}
+	entityURI := func(table string) string {
+		return baseURI + table + "/"
+	}
+
+	outgoing := &IntrospectedMappingConfig{BaseURI: entityURI(info.name)}
+	incoming := &IntrospectedMappingConfig{BaseURI: entityURI(info.name)}
+	identity := ""
+	if len(info.primaryKey) == 1 {
+		identity = info.primaryKey[0]
+	}
+	for _, c := range info.columns {
+		column := configName(c.name)
+		if c.name == identity {
+			outgoing.PropertyMappings = append(outgoing.PropertyMappings, &IntrospectedPropertyMapping{
+				Property: column, IsIdentity: true, URIValuePattern: entityURI(info.name) + "{value}",
+			})
+			incoming.PropertyMappings = append(incoming.PropertyMappings, &IntrospectedPropertyMapping{
+				Property: column, IsIdentity: true, StripReferencePrefix: true,
+			})
+			continue
+		}
+		out := &IntrospectedPropertyMapping{EntityProperty: c.name, Property: column}
+		in := &IntrospectedPropertyMapping{EntityProperty: c.name, Property: column}
+		if referenced, ok := info.foreignKeys[c.name]; ok {
+			out.IsReference, out.URIValuePattern = true, entityURI(referenced)+"{value}"
+			in.IsReference, in.StripReferencePrefix = true, true
+		}
+		outgoing.PropertyMappings = append(outgoing.PropertyMappings, out)
+		incoming.PropertyMappings = append(incoming.PropertyMappings, in)
+	}
+
+	sourceConfig := map[string]any{TableName: tableName}
+	if since := sinceColumnOf(info.columns); since != "" {
+		sourceConfig[SinceColumn] = configName(since)
+		sourceConfig[SinceDatatype] = "time"
+	}
+	return &IntrospectedDataset{
+		Name:                  info.name,
+		SourceConfig:          sourceConfig,
+		IncomingMappingConfig: incoming,
+		OutgoingMappingConfig: outgoing,
+	}
+}
+
+// configName returns a catalog name as written in configuration. Unquoted names are folded to
+// lower case, so names that would not survive that are quoted.
+func configName(name string) string {
+	for i, r := range name {
+		if !(r >= 'a' && r <= 'z' || r == '_' || i > 0 && (r >= '0' && r <= '9' || r == '$')) {
+			return quoteExact(name)
+		}
+	}
+	if name == "" {
+		return quoteExact(name)
+	}
+	return name
+}
+
+// sinceColumnOf returns the timestamp column with the most preferred since column name
+func sinceColumnOf(columns []columnInfo) string {
+	for _, name := range sinceColumnNames {
+		for _, c := range columns {
+			if strings.EqualFold(c.name, name) && strings.HasPrefix(c.dataType, "timestamp") {
+				return c.name
+			}
+		}
+	}
+	return ""
+}
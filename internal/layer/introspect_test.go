@@ -0,0 +1,106 @@
+package layer
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestIntrospectedDataset(t *testing.T) {
+	info := &tableInfo{
+		schema: "sales",
+		name:   "orders",
+		columns: []columnInfo{
+			{name: "id", dataType: "integer"},
+			{name: "customer_id", dataType: "integer"},
+			{name: "created_at", dataType: "timestamp with time zone"},
+			{name: "updated", dataType: "timestamp without time zone"},
+			{name: "updated_at", dataType: "text"},
+		},
+		primaryKey:  []string{"id"},
+		foreignKeys: map[string]string{"customer_id": "customers"},
+	}
+
+	data, err := json.Marshal(introspectedDataset(info, "public", "http://data.example.io"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"name":"orders","source_config":{"since_column":"updated","since_datatype":"time","table_name":"sales.orders"},` +
+		`"incoming_mapping_config":{"base_uri":"http://data.example.io/orders/","property_mappings":[` +
+		`{"property":"id","is_identity":true,"strip_ref_prefix":true},` +
+		`{"entity_property":"customer_id","property":"customer_id","is_reference":true,"strip_ref_prefix":true},` +
+		`{"entity_property":"created_at","property":"created_at"},` +
+		`{"entity_property":"updated","property":"updated"},` +
+		`{"entity_property":"updated_at","property":"updated_at"}]},` +
+		`"outgoing_mapping_config":{"base_uri":"http://data.example.io/orders/","property_mappings":[` +
+		`{"property":"id","is_identity":true,"uri_value_pattern":"http://data.example.io/orders/{value}"},` +
+		`{"entity_property":"customer_id","property":"customer_id","is_reference":true,"uri_value_pattern":"http://data.example.io/customers/{value}"},` +
+		`{"entity_property":"created_at","property":"created_at"},` +
+		`{"entity_property":"updated","property":"updated"},` +
+		`{"entity_property":"updated_at","property":"updated_at"}]}}`
+	if string(data) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, data)
+	}
+}
+
+func TestIntrospectedDatasetWithoutSingleKey(t *testing.T) {
+	info := &tableInfo{
+		schema:     "public",
+		name:       "order_line",
+		columns:    []columnInfo{{name: "order_id", dataType: "integer"}, {name: "pos", dataType: "integer"}},
+		primaryKey: []string{"order_id", "pos"},
+	}
+	ds := introspectedDataset(info, "public", "http://data.example.io/")
+	if ds.SourceConfig[TableName] != "order_line" {
+		t.Errorf("expected unqualified table name in public schema, got %v", ds.SourceConfig[TableName])
+	}
+	// tables outside the schema configured for the layer are qualified
+	if name := introspectedDataset(info, "sales", "http://data.example.io/").SourceConfig[TableName]; name != "public.order_line" {
+		t.Errorf("expected table name qualified with public, got %v", name)
+	}
+	for _, pm := range ds.OutgoingMappingConfig.PropertyMappings {
+		if pm.IsIdentity {
+			t.Errorf("expected no identity for a composite key, got %s", pm.Property)
+		}
+	}
+	if _, found := ds.SourceConfig[SinceColumn]; found {
+		t.Error("expected no since column")
+	}
+}
+
+func TestIntrospectedDatasetMixedCase(t *testing.T) {
+	info := &tableInfo{
+		schema: "Sales",
+		name:   "OrderLine",
+		columns: []columnInfo{
+			{name: "Id", dataType: "integer"},
+			{name: "order id", dataType: "integer"},
+			{name: "Updated_At", dataType: "timestamp with time zone"},
+			{name: "qty", dataType: "integer"},
+		},
+		primaryKey: []string{"Id"},
+	}
+	ds := introspectedDataset(info, "public", "http://data.example.io/")
+	if ds.SourceConfig[TableName] != `"Sales"."OrderLine"` {
+		t.Errorf("expected quoted table name, got %v", ds.SourceConfig[TableName])
+	}
+	if ds.SourceConfig[SinceColumn] != `"Updated_At"` {
+		t.Errorf("expected quoted since column, got %v", ds.SourceConfig[SinceColumn])
+	}
+	expected := []string{`"Id"`, `"order id"`, `"Updated_At"`, "qty"}
+	for i, pm := range ds.OutgoingMappingConfig.PropertyMappings {
+		if pm.Property != expected[i] || ds.IncomingMappingConfig.PropertyMappings[i].Property != expected[i] {
+			t.Errorf("expected column %s, got %s", expected[i], pm.Property)
+		}
+	}
+	if pm := ds.OutgoingMappingConfig.PropertyMappings[1]; pm.EntityProperty != "order id" {
+		t.Errorf("expected the entity property to keep the column name, got %s", pm.EntityProperty)
+	}
+
+	// the generated names resolve to the catalog names again
+	if name := unqualifiedName(ds.SourceConfig[TableName].(string)); identifierName(name) != "OrderLine" {
+		t.Errorf("expected the table name to resolve to OrderLine, got %s", identifierName(name))
+	}
+	if !ds.OutgoingMappingConfig.PropertyMappings[0].IsIdentity {
+		t.Error("expected the mixed case key to be the identity")
+	}
+}
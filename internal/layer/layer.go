@@ -5,19 +5,37 @@ import (
 	common "github.com/mimiro-io/common-datalayer"
 	"os"
 	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 type PgsqlDatalayer struct {
+	// state holds the connections and datasets of the current configuration, it is replaced
+	// as a whole on reload
+	state   atomic.Pointer[layerState]
+	reload  sync.Mutex
+	logger  common.Logger
+	metrics common.Metrics
+}
+
+// layerState is a configuration of the layer, it is not changed once in use
+type layerState struct {
+	config *common.Config
+	// system is a copy of the native system config, see changedSettings
+	system map[string]any
+	// pools holds the connection pools of the layer and its datasets
+	pools    *poolRegistry
 	db       *pgsqlDB
 	datasets map[string]*Dataset
-	config   *common.Config
-	logger   common.Logger
-	metrics  common.Metrics
 }
 
 type Dataset struct {
-	logger            common.Logger
-	db                *pgsqlDB
+	logger common.Logger
+	db     *pgsqlDB
+	// pools is the registry of db, reads and writes hold on to it until they are closed
+	pools *poolRegistry
+	// layer is the layer the dataset belongs to, or nil for datasets created on their own
+	layer             *PgsqlDatalayer
 	datasetDefinition *common.DatasetDefinition
 }
 
@@ -29,17 +47,28 @@ func (d *Dataset) Name() string {
 	return d.datasetDefinition.DatasetName
 }
 
-func (dl *PgsqlDatalayer) Stop(ctx context.Context) error {
-	err := dl.db.db.Close()
-	if err != nil {
-		return err
+// schema returns the schema of the dataset tables, the schema of the source config or else
+// the schema of the layer
+func (d *Dataset) schema() string {
+	if s := getStringConfigProperty(d.datasetDefinition.SourceConfig, Schema); s != "" {
+		return s
 	}
+	if d.db != nil {
+		return d.db.schema
+	}
+	return ""
+}
 
-	return nil
+func (dl *PgsqlDatalayer) Stop(ctx context.Context) error {
+	state := dl.state.Load()
+	if state == nil {
+		return nil
+	}
+	return state.pools.close()
 }
 
 func (dl *PgsqlDatalayer) Dataset(dataset string) (common.Dataset, common.LayerError) {
-	ds, found := dl.datasets[dataset]
+	ds, found := dl.state.Load().datasets[dataset]
 	if found {
 		return ds, nil
 	}
@@ -48,7 +77,7 @@ func (dl *PgsqlDatalayer) Dataset(dataset string) (common.Dataset, common.LayerE
 
 func (dl *PgsqlDatalayer) DatasetDescriptions() []*common.DatasetDescription {
 	var datasetDescriptions []*common.DatasetDescription
-	for key := range dl.datasets {
+	for key := range dl.state.Load().datasets {
 		datasetDescriptions = append(datasetDescriptions, &common.DatasetDescription{Name: key})
 	}
 	sort.Slice(datasetDescriptions, func(i, j int) bool {
@@ -58,18 +87,11 @@ func (dl *PgsqlDatalayer) DatasetDescriptions() []*common.DatasetDescription {
 }
 
 func NewPgsqlDataLayer(conf *common.Config, logger common.Logger, metrics common.Metrics) (common.DataLayerService, error) {
-	pgsqldb, err := newPgsqlDB(conf)
-	if err != nil {
-		return nil, err
-	}
 	l := &PgsqlDatalayer{
-		datasets: map[string]*Dataset{},
-		logger:   logger,
-		metrics:  metrics,
-		config:   conf,
-		db:       pgsqldb,
+		logger:  logger,
+		metrics: metrics,
 	}
-	err = l.UpdateConfiguration(conf)
+	err := l.UpdateConfiguration(conf)
 	if err != nil {
 		return nil, err
 	}
@@ -83,6 +105,8 @@ func EnrichConfig(config *common.Config) error {
 	database := os.Getenv("PGSQL_DATABASE")
 	host := os.Getenv("PGSQL_HOST")
 	port := os.Getenv("PGSQL_PORT")
+	sslMode := os.Getenv("PGSQL_SSLMODE")
+	connectionString := os.Getenv("PGSQL_CONNECTION_STRING")
 
 	if user != "" {
 		config.NativeSystemConfig["user"] = user
@@ -104,5 +128,13 @@ func EnrichConfig(config *common.Config) error {
 		config.NativeSystemConfig["port"] = port
 	}
 
+	if sslMode != "" {
+		config.NativeSystemConfig["sslmode"] = sslMode
+	}
+
+	if connectionString != "" {
+		config.NativeSystemConfig["connection_string"] = connectionString
+	}
+
 	return nil
 }
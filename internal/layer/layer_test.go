@@ -0,0 +1,333 @@
+package layer
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+// testState returns a configuration with a pool that is never connected
+func testState(t *testing.T, dl *PgsqlDatalayer, names ...string) *layerState {
+	config, err := pgx.ParseConfig("postgres://postgres@localhost:1/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &pgsqlDB{db: sql.OpenDB(stdlib.GetConnector(*config))}
+	pools := newPoolRegistry(nil)
+	pools.pools["test"] = db
+	state := &layerState{pools: pools, db: db, datasets: map[string]*Dataset{}}
+	for _, name := range names {
+		state.datasets[name] = &Dataset{
+			db:                db,
+			pools:             pools,
+			layer:             dl,
+			datasetDefinition: &cdl.DatasetDefinition{DatasetName: name, SourceConfig: map[string]any{}},
+		}
+	}
+	return state
+}
+
+func isClosed(r *poolRegistry) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+func TestReloadDrainsPreviousPools(t *testing.T) {
+	dl := &PgsqlDatalayer{}
+	first := testState(t, dl, "products")
+	dl.swapState(first)
+
+	ds, err := dl.Dataset("products")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inFlight, release := ds.(*Dataset).acquire()
+	if inFlight != ds {
+		t.Fatal("expected the dataset of the current configuration")
+	}
+
+	dl.swapState(testState(t, dl, "products", "customers"))
+	if _, err := dl.Dataset("customers"); err != nil {
+		t.Fatalf("expected the dataset of the new configuration, got %v", err)
+	}
+	if isClosed(first.pools) {
+		t.Fatal("expected the previous pools to stay open while in use")
+	}
+	release()
+	if !isClosed(first.pools) {
+		t.Fatal("expected the previous pools to be closed once released")
+	}
+	if err := first.db.db.Ping(); err == nil || err.Error() != "sql: database is closed" {
+		t.Fatalf("expected a closed database, got %v", err)
+	}
+
+	// a dataset looked up before the reload moves on to the current configuration
+	current, release := ds.(*Dataset).acquire()
+	defer release()
+	if current == ds || current.pools == first.pools {
+		t.Fatal("expected the dataset of the current configuration")
+	}
+}
+
+func TestRetiredPoolsWaitForLongReads(t *testing.T) {
+	dl := &PgsqlDatalayer{}
+	state := testState(t, dl, "products")
+	state.pools.logger = cdl.NewLogger("test", "text", "info")
+	_, release := state.datasets["products"].acquire()
+
+	// a read outlasting the warning keeps the pools open until it is done
+	state.pools.retire(time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if isClosed(state.pools) {
+		t.Fatal("expected the pools to stay open while in use")
+	}
+	release()
+	if !isClosed(state.pools) {
+		t.Fatal("expected the pools to be closed once released")
+	}
+}
+
+func TestConcurrentReload(t *testing.T) {
+	dl := &PgsqlDatalayer{}
+	dl.swapState(testState(t, dl, "products"))
+
+	var retired []*poolRegistry
+
+	var readers sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ds, err := dl.Dataset("products")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				d, release := ds.(*Dataset).acquire()
+				if isClosed(d.pools) {
+					t.Error("expected the pools of an acquired dataset to be open")
+				}
+				_ = dl.DatasetDescriptions()
+				_ = d.schema()
+				release()
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		previous := dl.state.Load()
+		dl.swapState(testState(t, dl, "products"))
+		retired = append(retired, previous.pools)
+	}
+	close(stop)
+	readers.Wait()
+
+	for i, r := range retired {
+		if !isClosed(r) {
+			t.Errorf("expected retired pools %d to be closed", i)
+		}
+	}
+	if err := dl.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPool returns the pool of the native config, without connecting it
+func testPool(t *testing.T, native map[string]any) *pgsqlDB {
+	c, err := pgsqlConfOf(native)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, perr := pgx.ParseConfig(c.dsn())
+	if perr != nil {
+		t.Fatal(perr)
+	}
+	db := &pgsqlDB{db: sql.OpenDB(stdlib.GetConnector(*config)), identity: c.identity()}
+	db.refs.Add(1)
+	return db
+}
+
+// testLayer returns a layer with the pool of the native config, without connecting it
+func testLayer(t *testing.T, native map[string]any, definitions ...*cdl.DatasetDefinition) *PgsqlDatalayer {
+	dl := &PgsqlDatalayer{logger: cdl.NewLogger("test", "text", "info")}
+	db := testPool(t, native)
+	pools := newPoolRegistry(dl.logger)
+	pools.pools[db.identity] = db
+	state := &layerState{
+		config:   &cdl.Config{NativeSystemConfig: native, DatasetDefinitions: definitions},
+		system:   cloneSettings(native),
+		pools:    pools,
+		db:       db,
+		datasets: map[string]*Dataset{},
+	}
+	for _, dsd := range definitions {
+		state.datasets[dsd.DatasetName] = &Dataset{logger: dl.logger, db: db, pools: pools, layer: dl, datasetDefinition: dsd}
+	}
+	dl.swapState(state)
+	return dl
+}
+
+func mappedDefinition(name string, table string) *cdl.DatasetDefinition {
+	return &cdl.DatasetDefinition{
+		DatasetName:           name,
+		SourceConfig:          map[string]any{TableName: table},
+		OutgoingMappingConfig: &cdl.OutgoingMappingConfig{BaseURI: "http://data.sample.org/", MapAll: true},
+	}
+}
+
+func TestReloadKeepsUnchangedConnections(t *testing.T) {
+	native := map[string]any{"host": "localhost", "port": "1", "database": "test", "user": "postgres"}
+	dl := testLayer(t, native, mappedDefinition("products", "product"))
+	first := dl.state.Load()
+
+	// no connection is made, the test pool cannot connect
+	config := &cdl.Config{
+		NativeSystemConfig: cloneSettings(native),
+		DatasetDefinitions: []*cdl.DatasetDefinition{mappedDefinition("products", "product"), mappedDefinition("customers", "customer")},
+	}
+	if err := dl.UpdateConfiguration(config); err != nil {
+		t.Fatal(err)
+	}
+	second := dl.state.Load()
+	if second.pools != first.pools || isClosed(first.pools) {
+		t.Fatal("expected the pools to be kept")
+	}
+	if second.datasets["products"] != first.datasets["products"] {
+		t.Error("expected the unchanged dataset to be kept")
+	}
+	if second.datasets["customers"] == nil || second.datasets["customers"].db != first.db {
+		t.Error("expected the added dataset on the kept pool")
+	}
+
+	// the same configuration once more changes nothing
+	config = &cdl.Config{
+		NativeSystemConfig: cloneSettings(native),
+		DatasetDefinitions: []*cdl.DatasetDefinition{mappedDefinition("products", "product"), mappedDefinition("customers", "customer")},
+	}
+	if err := dl.UpdateConfiguration(config); err != nil {
+		t.Fatal(err)
+	}
+	if dl.state.Load() != second {
+		t.Error("expected the state to be kept for an unchanged configuration")
+	}
+
+	config.DatasetDefinitions = []*cdl.DatasetDefinition{mappedDefinition("products", "products_v2")}
+	if err := dl.UpdateConfiguration(config); err != nil {
+		t.Fatal(err)
+	}
+	third := dl.state.Load()
+	if third.pools != first.pools || third.datasets["products"] == second.datasets["products"] || third.datasets["customers"] != nil {
+		t.Error("expected the changed dataset to be replaced and the removed one dropped")
+	}
+
+	// a changed system config reconnects, and keeps the layer as it was when that fails
+	config.NativeSystemConfig = map[string]any{"host": "localhost", "port": "1", "database": "other", "user": "postgres"}
+	if err := dl.UpdateConfiguration(config); err == nil {
+		t.Fatal("expected the connection to fail")
+	}
+	if dl.state.Load() != third || isClosed(third.pools) {
+		t.Error("expected the previous configuration to be kept")
+	}
+}
+
+func TestReloadCarriesOverConnections(t *testing.T) {
+	native := map[string]any{"host": "localhost", "port": "1", "database": "test", "user": "postgres"}
+	archive := mappedDefinition("archive", "orders")
+	archive.SourceConfig[Connection] = map[string]any{"database": "archive"}
+	dl := testLayer(t, native, mappedDefinition("products", "product"))
+	first := dl.state.Load()
+	archiveNative, _ := datasetConnectionConfig(native, archive.SourceConfig)
+	archiveDB := testPool(t, archiveNative)
+	first.pools.pools[archiveDB.identity] = archiveDB
+	first.datasets["archive"] = &Dataset{logger: dl.logger, db: archiveDB, pools: first.pools, layer: dl, datasetDefinition: archive}
+
+	// dropping the archive dataset connects nothing, the system pool is carried over
+	config := &cdl.Config{
+		NativeSystemConfig: cloneSettings(native),
+		DatasetDefinitions: []*cdl.DatasetDefinition{mappedDefinition("products", "product")},
+	}
+	if err := dl.UpdateConfiguration(config); err != nil {
+		t.Fatal(err)
+	}
+	second := dl.state.Load()
+	if second.pools == first.pools || second.db != first.db || second.datasets["products"].db != first.db {
+		t.Fatal("expected the system pool to be carried over to a registry of its own")
+	}
+	if !isClosed(first.pools) {
+		t.Error("expected the previous registry to be retired")
+	}
+	if err := archiveDB.db.Ping(); err == nil || err.Error() != "sql: database is closed" {
+		t.Errorf("expected the pool no longer needed to be closed, got %v", err)
+	}
+	if err := first.db.db.Ping(); err != nil && err.Error() == "sql: database is closed" {
+		t.Error("expected the carried over pool to stay open")
+	}
+
+	// the carried over pool is closed with the last registry holding it
+	if err := dl.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.db.db.Ping(); err == nil || err.Error() != "sql: database is closed" {
+		t.Errorf("expected the pool to be closed on stop, got %v", err)
+	}
+}
+
+func TestReloadRejectsInvalidConfiguration(t *testing.T) {
+	native := map[string]any{"host": "localhost", "port": "1", "database": "test", "user": "postgres"}
+	dl := testLayer(t, native, mappedDefinition("products", "product"))
+	first := dl.state.Load()
+
+	invalid := mappedDefinition("customers", "customer")
+	invalid.SourceConfig[SinceDatatype] = "date"
+	config := &cdl.Config{
+		NativeSystemConfig: cloneSettings(native),
+		DatasetDefinitions: []*cdl.DatasetDefinition{mappedDefinition("products", "product_v2"), invalid},
+	}
+	err := dl.UpdateConfiguration(config)
+	if err == nil || !strings.Contains(err.Error(), "dataset customers: since_datatype") {
+		t.Fatalf("expected the configuration to be rejected, got %v", err)
+	}
+	if dl.state.Load() != first || isClosed(first.pools) {
+		t.Error("expected the previous configuration to be kept")
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	native := map[string]any{"host": "localhost", "port": "1", "password": "secret", "runtime_params": map[string]any{"search_path": "a"}}
+	dl := testLayer(t, native)
+
+	next := cloneSettings(native)
+	next["password"] = "other"
+	next["runtime_params"].(map[string]any)["search_path"] = "b"
+	delete(next, "port")
+	next["sslmode"] = "require"
+	changed := changedSettings(dl.state.Load(), next)
+	expected := "password,port,runtime_params,sslmode"
+	if got := strings.Join(changed, ","); got != expected {
+		t.Errorf("expected changed settings %s, got %s", expected, got)
+	}
+
+	// settings changed in place are compared with the copy of the state
+	native["host"] = "elsewhere"
+	if got := changedSettings(dl.state.Load(), native); len(got) != 1 || got[0] != "host" {
+		t.Errorf("expected the host to have changed, got %v", got)
+	}
+	if !(&configChanges{}).empty() || (&configChanges{removed: []string{"products"}}).empty() {
+		t.Error("unexpected empty changes")
+	}
+}
@@ -0,0 +1,340 @@
+package layer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+// addressSettings are the connection settings that pick the server, database and user. A
+// dataset overriding any of them does not use the connection string and read replicas of the
+// system config.
+var addressSettings = []string{"host", "port", "database", "user", "password"}
+
+// datasetConnectionConfig returns the native system config with the connection overrides of
+// the dataset, see Connection. Datasets without overrides use the system config as is.
+func datasetConnectionConfig(system map[string]any, sourceConfig map[string]any) (map[string]any, error) {
+	v, ok := sourceConfig[Connection]
+	if !ok || v == nil {
+		return system, nil
+	}
+	overrides, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s must be an object of connection settings", Connection)
+	}
+
+	return overlayConnection(system, overrides), nil
+}
+
+// overlayConnection returns the base config with the overrides. Settings of the base that
+// belong to its address are left out when the overrides point elsewhere.
+func overlayConnection(base map[string]any, overrides map[string]any) map[string]any {
+	native := maps.Clone(base)
+	if native == nil {
+		native = map[string]any{}
+	}
+	for _, key := range addressSettings {
+		if _, ok := overrides[key]; ok {
+			for _, dependent := range []string{"connection_string", ReadReplicas} {
+				if _, ok := overrides[dependent]; !ok {
+					delete(native, dependent)
+				}
+			}
+			break
+		}
+	}
+	maps.Copy(native, overrides)
+	return native
+}
+
+// drainWarning is how long the reads and writes of a previous configuration may take before
+// they are logged, as they keep its pools open
+const drainWarning = 10 * time.Minute
+
+// poolRegistry holds a connection pool per connection identity, so that datasets with the
+// same connection settings share a pool. The pools are opened while the configuration is
+// loaded, and only read afterwards. A pool may be held by the registries of several
+// configurations, it is closed with the last of them.
+type poolRegistry struct {
+	pools  map[string]*pgsqlDB
+	logger cdl.Logger
+	// previous is the registry of the current configuration while the next one is loaded,
+	// the pools they have in common are carried over instead of connecting again
+	previous *poolRegistry
+	// opened counts the pools the registry connected itself
+	opened int
+
+	mu sync.Mutex
+	// active counts the reads and writes in flight, see acquire, and holders counts them by dataset
+	active  int
+	holders map[string]int
+	retired bool
+	closed  bool
+}
+
+func newPoolRegistry(logger cdl.Logger) *poolRegistry {
+	return &poolRegistry{pools: map[string]*pgsqlDB{}, logger: logger}
+}
+
+// identity returns the key of the pool of a configuration. All settings take part, as pool
+// limits and timeouts apply to the pool as a whole.
+func (c *PgsqlConf) identity() string {
+	key, _ := json.Marshal(c)
+	return string(key)
+}
+
+// get returns the pool of the native config, connecting when there is none yet
+func (r *poolRegistry) get(native map[string]any) (*pgsqlDB, error) {
+	c, cerr := pgsqlConfOf(native)
+	if cerr != nil {
+		return nil, cerr
+	}
+	key := c.identity()
+	if db, ok := r.pools[key]; ok {
+		return db, nil
+	}
+	if r.previous != nil {
+		if db, ok := r.previous.pools[key]; ok && r.carry(db) {
+			return db, nil
+		}
+	}
+	db, err := openPgsqlDB(c)
+	if err != nil {
+		return nil, err
+	}
+	db.identity = key
+	db.refs.Add(1)
+	r.pools[key] = db
+	r.opened++
+
+	if c.MaxReplicaLag != "" {
+		db.maxReplicaLag, err = parseTimeout(MaxReplicaLag, c.MaxReplicaLag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, overrides := range c.ReadReplicas {
+		replica, err := r.get(replicaConfig(native, overrides))
+		if err != nil {
+			return nil, fmt.Errorf("could not connect read replica %d because %w", i+1, err)
+		}
+		db.replicas = append(db.replicas, replica)
+	}
+	return db, nil
+}
+
+// carry adds a pool of another registry with its read replicas. It fails when the pool has
+// been closed since.
+func (r *poolRegistry) carry(db *pgsqlDB) bool {
+	var held []*pgsqlDB
+	for _, p := range append([]*pgsqlDB{db}, db.replicas...) {
+		if _, ok := r.pools[p.identity]; ok {
+			continue
+		}
+		if !p.retain() {
+			for _, h := range held {
+				_ = h.release()
+			}
+			return false
+		}
+		held = append(held, p)
+	}
+	for _, p := range held {
+		r.pools[p.identity] = p
+	}
+	return true
+}
+
+// retain adds a registry holding the pool, unless it is closed already
+func (db *pgsqlDB) retain() bool {
+	for {
+		n := db.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if db.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// release lets go of the pool for a registry, the last one closes it
+func (db *pgsqlDB) release() error {
+	if db.refs.Add(-1) > 0 {
+		return nil
+	}
+	return db.db.Close()
+}
+
+// serves tells if the registry has the pools of the native configs and no others, so that it
+// can be kept for a configuration needing them
+func (r *poolRegistry) serves(natives []map[string]any) bool {
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return false
+	}
+	needed := map[string]bool{}
+	for _, native := range natives {
+		c, err := pgsqlConfOf(native)
+		if err != nil {
+			return false
+		}
+		db, ok := r.pools[c.identity()]
+		if !ok {
+			return false
+		}
+		needed[db.identity] = true
+		for _, replica := range db.replicas {
+			needed[replica.identity] = true
+		}
+	}
+	return len(needed) == len(r.pools)
+}
+
+// acquire marks the start of a read or write of the dataset on the pools. The pools are not
+// closed by retire before the returned release function is called. It fails when the pools are
+// closed.
+func (r *poolRegistry) acquire(dataset string) (func(), bool) {
+	if r == nil {
+		return func() {}, true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, false
+	}
+	r.active++
+	if r.holders == nil {
+		r.holders = map[string]int{}
+	}
+	r.holders[dataset]++
+	var once sync.Once
+	return func() {
+		once.Do(func() { r.release(dataset) })
+	}, true
+}
+
+func (r *poolRegistry) release(dataset string) {
+	r.mu.Lock()
+	r.active--
+	if r.holders[dataset]--; r.holders[dataset] == 0 {
+		delete(r.holders, dataset)
+	}
+	drained := r.retired && r.active == 0 && r.markClosed()
+	r.mu.Unlock()
+	if drained {
+		r.closePools()
+	}
+}
+
+// leaseIterator releases the pools of a read when it is closed
+type leaseIterator struct {
+	cdl.EntityIterator
+	release func()
+}
+
+func (it *leaseIterator) Close() cdl.LayerError {
+	defer it.release()
+	return it.EntityIterator.Close()
+}
+
+// leasedIterator returns the iterator of a read that acquired the pools, releasing them when
+// the read failed
+func leasedIterator(iter cdl.EntityIterator, err cdl.LayerError, release func()) (cdl.EntityIterator, cdl.LayerError) {
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &leaseIterator{EntityIterator: iter, release: release}, nil
+}
+
+// retire closes the pools once the reads and writes in flight are released. Long running
+// streams and full syncs keep them open, those still in flight after the warning delay are
+// logged.
+func (r *poolRegistry) retire(warning time.Duration) {
+	r.mu.Lock()
+	r.retired = true
+	drained := r.active == 0 && r.markClosed()
+	r.mu.Unlock()
+	if drained {
+		r.closePools()
+		return
+	}
+	time.AfterFunc(warning, func() {
+		r.mu.Lock()
+		active, closed := r.active, r.closed
+		datasets := slices.Sorted(maps.Keys(r.holders))
+		r.mu.Unlock()
+		if !closed && r.logger != nil {
+			r.logger.Warn("reads and writes of a previous configuration still hold its connections",
+				"active", active, "datasets", strings.Join(datasets, ","), "after", warning.String())
+		}
+	})
+}
+
+// markClosed marks the registry closed, it tells if it was open. The caller holds mu.
+func (r *poolRegistry) markClosed() bool {
+	if r.closed {
+		return false
+	}
+	r.closed = true
+	return true
+}
+
+// close closes all pools of the registry, closing it again does nothing
+func (r *poolRegistry) close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	open := r.markClosed()
+	r.mu.Unlock()
+	if !open {
+		return nil
+	}
+	return r.closePools()
+}
+
+func (r *poolRegistry) closePools() error {
+	var errs []error
+	for _, db := range r.pools {
+		if err := db.release(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	err := errors.Join(errs...)
+	if err != nil && r.logger != nil {
+		r.logger.Warn("could not close database connection", "error", err)
+	}
+	return err
+}
+
+// acquire returns the dataset with its pools acquired, see poolRegistry.acquire. A dataset
+// of a configuration that has been replaced since it was looked up is exchanged for the
+// dataset of the same name in the current configuration.
+func (d *Dataset) acquire() (*Dataset, func()) {
+	for {
+		release, ok := d.pools.acquire(d.Name())
+		if ok {
+			return d, release
+		}
+		var next *Dataset
+		if d.layer != nil {
+			next = d.layer.state.Load().datasets[d.Name()]
+		}
+		if next == nil || next == d {
+			// the dataset was removed, it fails on its closed pools
+			return d, func() {}
+		}
+		d = next
+	}
+}
@@ -0,0 +1,96 @@
+package layer
+
+import (
+	"testing"
+)
+
+func TestDatasetConnectionConfig(t *testing.T) {
+	system := map[string]any{"host": "primary", "port": "5432", "database": "sales", "user": "layer", "password": "secret"}
+
+	native, err := datasetConnectionConfig(system, map[string]any{TableName: "orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if native["host"] != "primary" {
+		t.Errorf("expected the system config without overrides, got %v", native)
+	}
+
+	native, err = datasetConnectionConfig(system, map[string]any{
+		TableName:  "orders",
+		Connection: map[string]any{"host": "archive", "database": "archive", "max_open_connections": 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if native["host"] != "archive" || native["database"] != "archive" || native["user"] != "layer" || native["max_open_connections"] != 2 {
+		t.Errorf("unexpected dataset connection config %v", native)
+	}
+	if system["host"] != "primary" {
+		t.Errorf("expected the system config to be left as is, got %v", system)
+	}
+
+	withConnectionString := map[string]any{"connection_string": "host=primary dbname=sales"}
+	native, _ = datasetConnectionConfig(withConnectionString, map[string]any{Connection: map[string]any{"host": "archive"}})
+	if _, ok := native["connection_string"]; ok {
+		t.Errorf("expected the system connection string to be dropped, got %v", native)
+	}
+	native, _ = datasetConnectionConfig(withConnectionString, map[string]any{Connection: map[string]any{"statement_timeout": "5s"}})
+	if native["connection_string"] != "host=primary dbname=sales" {
+		t.Errorf("expected the system connection string to be kept, got %v", native)
+	}
+
+	if _, err := datasetConnectionConfig(system, map[string]any{Connection: "host=archive"}); err == nil {
+		t.Error("expected an error for a connection that is not an object")
+	}
+}
+
+func TestPoolIdentity(t *testing.T) {
+	identity := func(native map[string]any) string {
+		c, err := pgsqlConfOf(native)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.identity()
+	}
+	base := map[string]any{"host": "primary", "database": "sales", "user": "layer"}
+	same, _ := datasetConnectionConfig(base, map[string]any{Connection: map[string]any{"host": "primary"}})
+	if identity(base) != identity(same) {
+		t.Error("expected datasets with the same connection settings to share a pool")
+	}
+	for _, overrides := range []map[string]any{
+		{"user": "reader"},
+		{"database": "archive"},
+		{"max_open_connections": 2},
+		{"statement_timeout": "5s"},
+	} {
+		other, _ := datasetConnectionConfig(base, map[string]any{Connection: overrides})
+		if identity(base) == identity(other) {
+			t.Errorf("expected a pool of its own for %v", overrides)
+		}
+	}
+}
+
+func TestDatasetPoolLimits(t *testing.T) {
+	system := map[string]any{"host": "primary", "database": "sales", MaxOpenConnections: 10}
+	for _, limits := range []map[string]any{
+		{MaxOpenConnections: 4, MaxIdleConnections: 1},
+		{MaxOpenConnections: float64(4), MaxIdleConnections: "1"},
+		{MaxOpenConnections: "4", MaxIdleConnections: 1.0},
+	} {
+		native, err := datasetConnectionConfig(system, map[string]any{Connection: limits})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := pgsqlConfOf(native)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.MaxOpenConnections != 4 || c.MaxIdleConnections != 1 {
+			t.Errorf("expected the pool limits of %v, got %d and %d", limits, c.MaxOpenConnections, c.MaxIdleConnections)
+		}
+	}
+	c, _ := pgsqlConfOf(system)
+	if c.MaxOpenConnections != 10 || c.MaxIdleConnections != 0 {
+		t.Errorf("expected the system pool limits, got %d and %d", c.MaxOpenConnections, c.MaxIdleConnections)
+	}
+}
@@ -8,20 +8,30 @@ import (
 	"fmt"
 	cdl "github.com/mimiro-io/common-datalayer"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
-	"reflect"
 	"strconv"
 	"strings"
-	"time"
 )
 
 func (d *Dataset) Changes(since string, limit int, latestOnly bool) (cdl.EntityIterator, cdl.LayerError) {
-	if latestOnly {
-		// the layer does not know if the given table is a "change" table or not, so we cannot support this mode with confidence
+	d, release := d.acquire()
+	iter, err := d.changes(since, limit, latestOnly)
+	return leasedIterator(iter, err, release)
+}
+
+func (d *Dataset) changes(since string, limit int, latestOnly bool) (cdl.EntityIterator, cdl.LayerError) {
+	cdc := getStringConfigProperty(d.datasetDefinition.SourceConfig, CdcSlot) != ""
+	if latestOnly && (cdc || !getBooleanConfigProperty(d.datasetDefinition.SourceConfig, ChangeLog)) {
+		// unless the table is declared as a change log we do not know if it is a "change" table or not,
+		// so we cannot support this mode with confidence
 		return nil, cdl.Err(fmt.Errorf("latest only operation not supported"), cdl.LayerNotSupported)
 	}
 
 	mapper := cdl.NewMapper(d.logger, d.datasetDefinition.IncomingMappingConfig, d.datasetDefinition.OutgoingMappingConfig)
-	iter, err := d.newIterator(mapper, since, limit)
+	if cdc {
+		return d.newCDCIterator(mapper, since, limit)
+	}
+
+	iter, err := d.newIterator(mapper, since, limit, latestOnly)
 	if err != nil {
 		return nil, err
 	}
@@ -29,10 +39,68 @@ func (d *Dataset) Changes(since string, limit int, latestOnly bool) (cdl.EntityI
 	return iter, nil
 }
 
+// Entities returns the current state of the dataset. Rows are read in identity order and the
+// continuation token holds the identity of the last row returned, so a snapshot can be paged
+// through with limit. Deleted entities are left out, and for change log tables only the latest
+// version of each entity is returned. For datasets with a since column the token of the last
+// page is the since token of the changes from before the snapshot, so that the changes can be
+// followed from there. Reading entities with that token returns an empty page.
 func (d *Dataset) Entities(from string, limit int) (cdl.EntityIterator, cdl.LayerError) {
-	// the layer does not know if the given table is a "change" table or not, so implement /entities as /changes
-	// TODO: consider adding source config options to allow for different behavior
-	return d.Changes(from, limit, false)
+	d, release := d.acquire()
+	iter, err := d.entities(from, limit)
+	return leasedIterator(iter, err, release)
+}
+
+func (d *Dataset) entities(from string, limit int) (cdl.EntityIterator, cdl.LayerError) {
+	mapper := cdl.NewMapper(d.logger, d.datasetDefinition.IncomingMappingConfig, d.datasetDefinition.OutgoingMappingConfig)
+
+	token, err := decodeEntitiesToken(from)
+	if err != nil {
+		return nil, ErrQuery(err)
+	}
+	if token.snapshotEnd() {
+		return &snapshotEndIterator{token: from}, nil
+	}
+
+	query, args, err := buildEntitiesQuery(d.datasetDefinition, d.schema(), from, limit)
+	d.logger.Debug(fmt.Sprintf("entities query for dataset %s: %s", d.Name(), query), "dataset", d.Name())
+	if err != nil {
+		d.logger.Error("failed to build query", "error", err)
+		return nil, ErrQuery(err)
+	}
+
+	ctx, cancel, err := d.readContext()
+	if err != nil {
+		return nil, ErrQuery(err)
+	}
+	pool := d.readPool(ctx)
+
+	// the since value is taken before the first page is read, and handed on by the tokens of the next pages
+	sinceCol := getStringConfigProperty(d.datasetDefinition.SourceConfig, SinceColumn)
+	sinceDatatype := getStringConfigProperty(d.datasetDefinition.SourceConfig, SinceDatatype)
+	snapshotSince := token.Until
+	if snapshotSince == "" && sinceCol != "" && sinceDatatype != "" && getStringConfigProperty(d.datasetDefinition.SourceConfig, CdcSlot) == "" {
+		var lerr cdl.LayerError
+		snapshotSince, lerr = d.maxSinceValue(ctx, pool.db, d.maxSinceQuery(), sinceDatatype)
+		if lerr != nil {
+			cancel()
+			return nil, lerr
+		}
+	}
+
+	iter, lerr := d.queryIterator(ctx, pool, mapper, query, args, "", limit, from)
+	if lerr != nil {
+		cancel()
+		return nil, lerr
+	}
+	iter.cancel = cancel
+	if from != "" || limit != 0 {
+		// see buildEntitiesQuery, the rows of a complete snapshot are not ordered by key
+		iter.tokenColumn = columnKey(entitiesKeyColumn(d.datasetDefinition))
+	}
+	iter.snapshotSince = snapshotSince
+	iter.skipDeleted = true
+	return iter, nil
 }
 
 func getStringConfigProperty(config map[string]interface{}, key string) string {
@@ -61,6 +129,12 @@ func getBooleanConfigProperty(config map[string]interface{}, key string) bool {
 	return valBool
 }
 
+// deletedExpressionColumn is the alias the deleted expression is selected as
+const deletedExpressionColumn = "_deleted"
+
+// sinceTimeFormat is the format of time values in since tokens
+const sinceTimeFormat = "2006-01-02 15:04:05.000000"
+
 func getNextSinceValue(rows *sql.Rows, datatype string) (string, error) {
 	if datatype == "int" {
 		var maxValue sql.NullInt64
@@ -90,7 +164,7 @@ func getNextSinceValue(rows *sql.Rows, datatype string) (string, error) {
 			return "", err
 		}
 		if maxValue.Valid {
-			return maxValue.Time.Format("2006-01-02 15:04:05.000000"), nil
+			return maxValue.Time.Format(sinceTimeFormat), nil
 		} else {
 			return "", nil
 		}
@@ -98,50 +172,58 @@ func getNextSinceValue(rows *sql.Rows, datatype string) (string, error) {
 	return "", fmt.Errorf("unsupported datatype: %s", datatype)
 }
 
-func (d *Dataset) newIterator(mapper *cdl.Mapper, since string, limit int) (*dbIterator, cdl.LayerError) {
-	entityColumn := getStringConfigProperty(d.datasetDefinition.SourceConfig, EntityColumn)
+func (d *Dataset) newIterator(mapper *cdl.Mapper, since string, limit int, latestOnly bool) (*dbIterator, cdl.LayerError) {
+	// no timeout unless a read timeout is configured, to support long running stream operations
+	ctx, cancel, cerr := d.readContext()
+	if cerr != nil {
+		return nil, ErrQuery(cerr)
+	}
+	iter, lerr := d.changesIterator(ctx, d.readPool(ctx), mapper, since, limit, latestOnly)
+	if lerr != nil {
+		cancel()
+		return nil, lerr
+	}
+	iter.cancel = cancel
+	return iter, nil
+}
+
+// changesIterator reads the changes from the given pool. A read replica that has not seen
+// the changes up to the since token yet is passed over for the primary.
+func (d *Dataset) changesIterator(ctx context.Context, pool *pgsqlDB, mapper *cdl.Mapper, since string, limit int, latestOnly bool) (*dbIterator, cdl.LayerError) {
 	sinceCol := getStringConfigProperty(d.datasetDefinition.SourceConfig, SinceColumn)
 	sinceDatatype := getStringConfigProperty(d.datasetDefinition.SourceConfig, SinceDatatype)
 
-	ctx := context.Background() // no timeout because we want to support long running stream operations
-
-	db := d.db.db
+	db := pool.db
 
 	var nextToken string
 	var maxSince string
 
+	var window *sinceToken
+	if since != "" {
+		var err error
+		window, err = decodeSinceToken(since)
+		if err != nil {
+			return nil, ErrQuery(err)
+		}
+	}
+
 	if sinceCol != "" {
 		if sinceDatatype == "" {
 			d.logger.Error("since datatype not set in source config")
 			return nil, cdl.Err(fmt.Errorf("since datatype not set in source config"), cdl.LayerErrorInternal)
 		}
 
-		// since table
-		sinceTable := getStringConfigProperty(d.datasetDefinition.SourceConfig, SinceTable)
-		if sinceTable == "" {
-			sinceTable = d.datasetDefinition.SourceConfig[TableName].(string)
-		}
-
-		// build max since query
-		maxSinceQuery := "SELECT MAX(" + sinceCol + ") AS \"_MAX_SINCE\" FROM " + sinceTable
-		rows, err := db.QueryContext(ctx, maxSinceQuery)
-		if err != nil {
-			return nil, cdl.Err(err, cdl.LayerErrorInternal)
+		newSince, lerr := d.maxSinceValue(ctx, db, d.maxSinceQuery(), sinceDatatype)
+		if lerr != nil {
+			return nil, lerr
 		}
-		defer func() {
-			rows.Close()
-		}()
-
-		hasData := rows.Next()
-		if !hasData {
-			d.logger.Error("failed to get max since", "error", "no data")
-			return nil, cdl.Err(fmt.Errorf("failed to get max since"), cdl.LayerErrorInternal)
+		if pool != d.db && window != nil && sinceBehind(newSince, window.bound(), sinceDatatype) {
+			d.logger.Debug("read replica is behind the since token, reading from the primary", "dataset", d.Name())
+			return d.changesIterator(ctx, d.db, mapper, since, limit, latestOnly)
 		}
-
-		newSince, err := getNextSinceValue(rows, sinceDatatype)
-		if err != nil {
-			d.logger.Error("failed to get max since", "error", err)
-			return nil, cdl.Err(err, cdl.LayerErrorInternal)
+		if window != nil && window.Until != "" {
+			// a page of the latest changes continues within the since window of the first page
+			newSince = window.Until
 		}
 
 		// create encoded since
@@ -152,27 +234,134 @@ func (d *Dataset) newIterator(mapper *cdl.Mapper, since string, limit int) (*dbI
 	}
 
 	// build the query
-	query, err := buildQuery(d.datasetDefinition, since, maxSince, sinceDatatype, limit)
+	query, args, err := buildQuery(d.datasetDefinition, d.schema(), since, maxSince, sinceDatatype, limit, latestOnly)
 	d.logger.Debug(fmt.Sprintf("changes query for dataset %s: %s", d.Name(), query), "dataset", d.Name())
 	if err != nil {
 		d.logger.Error("failed to build query", "error", err)
 		return nil, ErrQuery(err)
 	}
 
-	rows, err := db.QueryContext(ctx, query)
+	iter, lerr := d.queryIterator(ctx, pool, mapper, query, args, since, limit, nextToken)
+	if lerr != nil {
+		return nil, lerr
+	}
+	if limit != 0 && !latestOnly && maxSince != "" {
+		iter.keysetSince = columnKey(keysetColumn(sinceCol, true))
+		iter.keysetTiebreaker = columnKey(keysetColumn(tiebreakerColumn(d.datasetDefinition), true))
+		// without them the token of a full page would skip the rest of the changes
+		if err := iter.selectedOnce(iter.keysetSince, iter.keysetTiebreaker); err != nil {
+			d.logger.Error("failed to page changes", "error", err, "dataset", d.Name())
+			_ = iter.Close()
+			return nil, ErrQuery(err)
+		}
+	}
+	if limit != 0 && latestOnly {
+		// the latest changes are paged by entity, a full page continues after its last entity
+		changeLogId, _ := changeLogColumns(d.datasetDefinition)
+		iter.keysetEntity = columnKey(changeLogId)
+		iter.window = &sinceToken{Until: maxSince}
+		if window != nil {
+			iter.window.Since = window.Since
+		}
+	}
+	return iter, nil
+}
+
+// maxSinceQuery returns the query of the latest since value of the dataset
+func (d *Dataset) maxSinceQuery() string {
+	sinceCol := getStringConfigProperty(d.datasetDefinition.SourceConfig, SinceColumn)
+	sinceTable := getStringConfigProperty(d.datasetDefinition.SourceConfig, SinceTable)
+	if sinceTable == "" {
+		sinceTable = getStringConfigProperty(d.datasetDefinition.SourceConfig, TableName)
+	}
+	if tombstoneTable := getStringConfigProperty(d.datasetDefinition.SourceConfig, TombstoneTable); tombstoneTable != "" {
+		return "SELECT GREATEST(MAX(" + quoteName(sinceCol) + "), (SELECT MAX(" + quoteIdentifier(tombstoneTimeColumn) + ") FROM " +
+			tableRef(d.schema(), tombstoneTable) + ")) AS \"_MAX_SINCE\" FROM " + tableRef(d.schema(), sinceTable)
+	}
+	return "SELECT MAX(" + quoteName(sinceCol) + ") AS \"_MAX_SINCE\" FROM " + tableRef(d.schema(), sinceTable)
+}
+
+func (d *Dataset) maxSinceValue(ctx context.Context, db *sql.DB, maxSinceQuery string, sinceDatatype string) (string, cdl.LayerError) {
+	rows, err := db.QueryContext(ctx, maxSinceQuery)
+	if err != nil {
+		return "", cdl.Err(err, cdl.LayerErrorInternal)
+	}
+	defer func() {
+		rows.Close()
+	}()
+
+	hasData := rows.Next()
+	if !hasData {
+		d.logger.Error("failed to get max since", "error", "no data")
+		return "", cdl.Err(fmt.Errorf("failed to get max since"), cdl.LayerErrorInternal)
+	}
+
+	newSince, err := getNextSinceValue(rows, sinceDatatype)
+	if err != nil {
+		d.logger.Error("failed to get max since", "error", err)
+		return "", cdl.Err(err, cdl.LayerErrorInternal)
+	}
+	return newSince, nil
+}
+
+// queryIterator runs the query on the pool and returns an iterator mapping the result rows to
+// entities. The given token is returned as continuation once the rows are exhausted.
+func (d *Dataset) queryIterator(ctx context.Context, pool *pgsqlDB, mapper *cdl.Mapper, query string, args []any, since string, limit int, nextToken string) (*dbIterator, cdl.LayerError) {
+	entityColumn := getStringConfigProperty(d.datasetDefinition.SourceConfig, EntityColumn)
+	sinceCol := getStringConfigProperty(d.datasetDefinition.SourceConfig, SinceColumn)
+	deletedCol, deletedVal := deletedMarker(d.datasetDefinition)
+	rels, err := outgoingRelations(d.datasetDefinition)
+	if err != nil {
+		return nil, ErrQuery(err)
+	}
+	relations := map[string]*relation{}
+	for _, rel := range rels {
+		relations[rel.Property] = rel
+	}
+
+	settings, err := sessionSettings(d.datasetDefinition.SourceConfig)
+	if err != nil {
+		return nil, ErrQuery(err)
+	}
+	// the timeouts of the dataset are set for a transaction of its own, so that they do not
+	// stick to the pooled connection
+	var tx *sql.Tx
+	var rows *sql.Rows
+	if len(settings) > 0 {
+		tx, err = pool.db.BeginTx(ctx, nil)
+		if err != nil {
+			d.logger.Error("failed to begin transaction", "error", err)
+			return nil, ErrQuery(err)
+		}
+		err = applySessionSettings(ctx, tx, settings)
+		if err == nil {
+			rows, err = tx.QueryContext(ctx, query, args...)
+		}
+	} else {
+		rows, err = pool.db.QueryContext(ctx, query, args...)
+	}
 	if err != nil {
 		d.logger.Error("failed to execute query", "error", err)
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+		return nil, ErrQuery(err)
+	}
+	fail := func(msg string, err error) (*dbIterator, cdl.LayerError) {
+		d.logger.Error(msg, "error", err)
+		_ = rows.Close()
+		if tx != nil {
+			_ = tx.Rollback()
+		}
 		return nil, ErrQuery(err)
 	}
 	cts, err := rows.ColumnTypes()
 	if err != nil {
-		d.logger.Error("failed to get column types", "error", err)
-		return nil, ErrQuery(err)
+		return fail("failed to get column types", err)
 	}
 	columns, err := rows.Columns()
 	if err != nil {
-		d.logger.Error("failed to get columns", "error", err)
-		return nil, ErrQuery(err)
+		return fail("failed to get columns", err)
 	}
 
 	// lower case all the columne
@@ -182,34 +371,11 @@ func (d *Dataset) newIterator(mapper *cdl.Mapper, since string, limit int) (*dbI
 
 	rowBuf := make([]any, 0, len(cts))
 	for _, ct := range cts {
-		dbType := ct.DatabaseTypeName()
-		if dbType == "JSONB" || dbType == "JSON" {
-			rowBuf = append(rowBuf, &json.RawMessage{})
-			continue
-		}
-
-		st := ct.ScanType()
-		if st == nil {
-			d.logger.Error("no scan type for column", "column", ct.Name())
-			return nil, ErrQuery(fmt.Errorf("no scan type for column %s", ct.Name()))
-		}
-		ex := reflect.New(st).Interface()
-		switch ex.(type) {
-		case *bool:
-			rowBuf = append(rowBuf, &sql.NullBool{})
-		case *int, *int32, *int64:
-			rowBuf = append(rowBuf, &sql.NullInt64{})
-		case *float32, *float64:
-			rowBuf = append(rowBuf, &sql.NullFloat64{})
-		case *time.Time:
-			rowBuf = append(rowBuf, &sql.NullTime{})
-		case *sql.NullInt32:
-			rowBuf = append(rowBuf, &sql.NullInt32{})
-		case *sql.NullTime:
-			rowBuf = append(rowBuf, &sql.NullTime{})
-		default:
-			rowBuf = append(rowBuf, &sql.NullString{})
+		buf, err := scanBuffer(ct)
+		if err != nil {
+			return fail("no scan buffer for column "+ct.Name(), err)
 		}
+		rowBuf = append(rowBuf, buf)
 	}
 
 	return &dbIterator{
@@ -218,108 +384,387 @@ func (d *Dataset) newIterator(mapper *cdl.Mapper, since string, limit int) (*dbI
 		limit:        limit,
 		mapper:       mapper,
 		rows:         rows,
+		tx:           tx,
 		currentToken: nextToken,
 		colTypes:     cts,
 		columns:      columns,
 		rowBuf:       rowBuf,
 		sinceColumn:  sinceCol,
-		entityColumn: entityColumn,
+		entityColumn: columnKey(entityColumn),
+		deletedCol:   deletedCol,
+		deletedVal:   deletedVal,
+		references:   referenceColumns(d.datasetDefinition),
+		relations:    relations,
 	}, nil
 }
 
-func buildQuery(definition *cdl.DatasetDefinition, since string, maxSince string, sinceDataType string, limit int) (string, error) {
+// buildQuery returns the query of the dataset. Tables without a schema of their own are
+// qualified with the given schema.
+func buildQuery(definition *cdl.DatasetDefinition, schema string, since string, maxSince string, sinceDataType string, limit int, latestOnly bool) (string, []any, error) {
 	entityColumn := getStringConfigProperty(definition.SourceConfig, EntityColumn)
 	sinceColumn := getStringConfigProperty(definition.SourceConfig, SinceColumn)
 	sinceTable := getStringConfigProperty(definition.SourceConfig, SinceTable)
 	dataQuery := getStringConfigProperty(definition.SourceConfig, DataQuery)
+	tableName := getStringConfigProperty(definition.SourceConfig, TableName)
+
+	// with a limit, rows are paged by since value and tie-breaker so that rows sharing a since
+	// value are neither skipped nor repeated
+	keyset := limit != 0 && !latestOnly && maxSince != "" && (sinceTable != "" || sinceColumn != "")
+	tiebreaker := tiebreakerColumn(definition)
+	deletedColumn := getStringConfigProperty(definition.SourceConfig, DeletedColumn)
+
+	// tombstones are only part of the changes, not of the current state
+	tombstoneTable := getStringConfigProperty(definition.SourceConfig, TombstoneTable)
+	tombstones := tombstoneTable != "" && maxSince != ""
+	if tombstones && (dataQuery != "" || tableName == "" || sinceColumn == "") {
+		return "", nil, fmt.Errorf("tombstone table requires table name and since column")
+	}
+
+	var changeLogId, changeLogOrder string
+	if latestOnly {
+		changeLogId, changeLogOrder = changeLogColumns(definition)
+		if changeLogId == "" || changeLogOrder == "" {
+			return "", nil, fmt.Errorf("change log identity and order columns are required for latest only")
+		}
+	}
+
+	rels, err := outgoingRelations(definition)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(rels) > 0 && dataQuery != "" {
+		return "", nil, fmt.Errorf("relations are not supported with a data query")
+	}
+	relationColumns := map[string]bool{}
+	for _, rel := range rels {
+		relationColumns[rel.Property] = true
+	}
 
 	cols := "*"
 	if definition.OutgoingMappingConfig == nil {
 		if entityColumn != "" {
 			cols = "*"
 		} else {
-			return "", fmt.Errorf("outgoing mapping config is missing")
+			return "", nil, fmt.Errorf("outgoing mapping config is missing")
 		}
 	} else {
 		if !definition.OutgoingMappingConfig.MapAll {
 			cols = ""
+			selected := map[string]bool{}
 			for _, pm := range definition.OutgoingMappingConfig.PropertyMappings {
+				// relation properties are selected from their child tables below
+				if relationColumns[columnKey(pm.Property)] {
+					continue
+				}
 				if len(cols) > 0 {
 					cols = cols + ", "
 				}
-				cols = cols + pm.Property
+				cols = cols + quoteIdentifier(pm.Property)
+				selected[columnKey(pm.Property)] = true
+			}
+			// the change log, deleted and paging columns must be part of the result
+			for _, col := range []string{changeLogId, changeLogOrder, deletedColumn, keysetColumn(sinceColumn, keyset || tombstones), keysetColumn(tiebreaker, keyset || tombstones)} {
+				if col != "" && !selected[columnKey(col)] {
+					cols = cols + ", " + quoteIdentifier(col)
+					selected[columnKey(col)] = true
+				}
 			}
 		}
 	}
 
+	// the table is referred to by its unqualified name, which is also the alias of the tombstone query
+	alias := quoteIdentifier(unqualifiedName(tableName))
+	for _, rel := range rels {
+		cols = cols + ", " + rel.selectExpr(alias, schema)
+	}
+
+	if expr := getStringConfigProperty(definition.SourceConfig, DeletedExpression); expr != "" {
+		if dataQuery != "" {
+			return "", nil, fmt.Errorf("deleted expression is not supported with a data query, select it as %s instead", deletedExpressionColumn)
+		}
+		cols = cols + ", (" + expr + ") AS " + deletedExpressionColumn
+	}
+
 	var q string
 	if dataQuery != "" {
 		q = dataQuery
 	} else {
-		q = "SELECT " + cols + " FROM " + definition.SourceConfig[TableName].(string)
+		table := tableRef(schema, tableName)
+		q = "SELECT " + cols + " FROM " + table
+		if tombstones {
+			q = tombstoneQuery(cols, table, alias, tableRef(schema, tombstoneTable), identityColumn(definition), sinceColumn)
+		}
 	}
 
+	var token *sinceToken
+	if since != "" {
+		token, err = decodeSinceToken(since)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	var args []any
 	if maxSince != "" {
+		sinceRef := ""
+		tiebreakerRef := quoteName(tiebreaker)
+		connectTerm := " WHERE "
 		if sinceTable != "" {
-			connectTerm := " AND "
-			if !strings.Contains(q, "WHERE") {
-				connectTerm = " WHERE "
+			sinceRef = quoteName(sinceTable) + "." + quoteIdentifier(sinceColumn)
+			if tiebreaker != "" && len(splitName(tiebreaker)) == 1 {
+				tiebreakerRef = quoteName(sinceTable) + "." + quoteIdentifier(tiebreaker)
 			}
-
-			if since != "" {
-				sinceValStr, err := base64.URLEncoding.DecodeString(since)
-				if err != nil {
-					return "", err
-				}
-
-				term := connectTerm + " %s.%s > %s AND %s.%s <= %s"
-				q += fmt.Sprintf(term,
-					sinceTable, sinceColumn, getQuotedValue(string(sinceValStr), sinceDataType),
-					sinceTable, sinceColumn, getQuotedValue(maxSince, sinceDataType))
-			} else {
-				term := connectTerm + " %s.%s <= %s"
-				q += fmt.Sprintf(term,
-					sinceTable, sinceColumn, getQuotedValue(maxSince, sinceDataType))
+			if strings.Contains(q, "WHERE") {
+				connectTerm = " AND "
 			}
 		} else if sinceColumn != "" {
-			if since != "" {
-				sinceValStr, err := base64.URLEncoding.DecodeString(since)
+			sinceRef = alias + "." + quoteIdentifier(sinceColumn)
+			if tiebreaker != "" && len(splitName(tiebreaker)) == 1 {
+				tiebreakerRef = alias + "." + quoteIdentifier(tiebreaker)
+			}
+		}
+
+		if sinceRef != "" {
+			if token != nil && token.Since != "" {
+				lower, err := sinceValue(token.Since, sinceDataType)
 				if err != nil {
-					return "", err
+					return "", nil, err
+				}
+				args = append(args, lower)
+				if token.Tiebreaker != "" {
+					args = append(args, token.Tiebreaker)
+					q += connectTerm + "(" + sinceRef + ", " + tiebreakerRef + ") > (" + sincePlaceholder(len(args)-1, sinceDataType) + ", $" + strconv.Itoa(len(args)) + ")"
+				} else {
+					q += connectTerm + sinceRef + " > " + sincePlaceholder(len(args), sinceDataType)
 				}
+				connectTerm = " AND "
+			}
 
-				q += fmt.Sprintf(" WHERE %s.%s > %s AND %s.%s <= %s",
-					definition.SourceConfig[TableName], definition.SourceConfig[SinceColumn], getQuotedValue(string(sinceValStr), sinceDataType),
-					definition.SourceConfig[TableName], definition.SourceConfig[SinceColumn], getQuotedValue(maxSince, sinceDataType))
-			} else {
-				q += fmt.Sprintf(" WHERE %s.%s <= %s",
-					definition.SourceConfig[TableName], definition.SourceConfig[SinceColumn], getQuotedValue(maxSince, sinceDataType))
+			upper, err := sinceValue(maxSince, sinceDataType)
+			if err != nil {
+				return "", nil, err
 			}
+			args = append(args, upper)
+			q += connectTerm + sinceRef + " <= " + sincePlaceholder(len(args), sinceDataType)
+			if keyset {
+				q += " ORDER BY " + sinceRef + ", " + tiebreakerRef
+			}
+		}
+	}
+	if latestOnly {
+		q = "SELECT DISTINCT ON (" + quoteIdentifier(changeLogId) + ") * FROM (" + q + ") AS changes"
+		if token != nil && token.After != "" {
+			args = append(args, token.After)
+			q += " WHERE " + quoteIdentifier(changeLogId) + " > $" + strconv.Itoa(len(args))
 		}
+		// rows without an order value, such as tombstones, are only the latest when there are no others
+		q += " ORDER BY " + quoteIdentifier(changeLogId) + ", " + quoteIdentifier(changeLogOrder) + " DESC NULLS LAST"
 	}
 	if limit != 0 {
-		q += " LIMIT " + strconv.Itoa(limit)
+		args = append(args, limit)
+		q += " LIMIT $" + strconv.Itoa(len(args))
 	}
-	return q, nil
+	return q, args, nil
 }
 
-func getQuotedValue(val string, datatype string) string {
+// sinceValue converts a decoded since token into a typed query argument, so that
+// the token is never spliced into the statement itself
+func sinceValue(val string, datatype string) (any, error) {
 	switch datatype {
-	case "int", "float":
-		return val
-	case "string":
-		return "'" + val + "'"
-	case "time":
-		return "'" + val + "'"
+	case "int":
+		v, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int since value %q: %w", val, err)
+		}
+		return v, nil
+	case "float":
+		v, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float since value %q: %w", val, err)
+		}
+		return v, nil
 	default:
-		return "'" + val + "'"
+		// string and time values are passed as text and converted by the server
+		return val, nil
 	}
 }
 
+// sinceToken is the continuation token of a limited page, the since value and tie-breaker of the last row.
+// A limited page of the latest changes holds the since window it was read from instead, and the
+// last entity of the page. The last page of an entities snapshot only holds the since value taken
+// before the snapshot, as the end of the window.
+type sinceToken struct {
+	Since      string `json:"since"`
+	Tiebreaker string `json:"tiebreaker"`
+	Until      string `json:"until,omitempty"`
+	After      string `json:"after,omitempty"`
+}
+
+// decodeSinceToken returns the since value, tie-breaker and window of a token. Tokens of complete
+// reads only hold the since value.
+func decodeSinceToken(token string) (*sinceToken, error) {
+	b, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 0 && b[0] == '{' {
+		st := &sinceToken{}
+		if json.Unmarshal(b, st) == nil && (st.Since != "" || st.Until != "" || st.After != "") {
+			if st.snapshotEnd() {
+				// the changes follow after the snapshot
+				return &sinceToken{Since: st.Until}, nil
+			}
+			return st, nil
+		}
+	}
+	return &sinceToken{Since: string(b)}, nil
+}
+
+func encodeSinceToken(since string, tiebreaker string) string {
+	return (&sinceToken{Since: since, Tiebreaker: tiebreaker}).encode()
+}
+
+func (t *sinceToken) encode() string {
+	b, _ := json.Marshal(t)
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// snapshotEnd tells if the token is that of the last page of an entities snapshot
+func (t *sinceToken) snapshotEnd() bool {
+	return t.Until != "" && t.Since == "" && t.After == ""
+}
+
+// bound returns the since value the changes of the token have been read up to
+func (t *sinceToken) bound() string {
+	if t.Until != "" {
+		return t.Until
+	}
+	return t.Since
+}
+
+// tiebreakerColumn returns the unique column that orders rows sharing a since value, by default the identity column
+func tiebreakerColumn(definition *cdl.DatasetDefinition) string {
+	if col := getStringConfigProperty(definition.SourceConfig, TiebreakerColumn); col != "" {
+		return col
+	}
+	return identityColumn(definition)
+}
+
+// keysetColumn returns the name of a paging column in the result set, or an empty string when not paging
+func keysetColumn(ref string, keyset bool) string {
+	if !keyset {
+		return ""
+	}
+	return unqualifiedName(ref)
+}
+
+// sincePlaceholder returns the positional parameter for a since bound. Time values are
+// cast explicitly, so they are interpreted like the timestamp literals of earlier tokens
+// regardless of whether the column is a timestamp, timestamptz or date
+func sincePlaceholder(pos int, datatype string) string {
+	if datatype == "time" {
+		return "$" + strconv.Itoa(pos) + "::timestamp"
+	}
+	return "$" + strconv.Itoa(pos)
+}
+
+// buildEntitiesQuery returns the dataset query without since filtering. When paging it is wrapped
+// in a query ordered by the identity column, starting after the identity in the from token
+func buildEntitiesQuery(definition *cdl.DatasetDefinition, schema string, from string, limit int) (string, []any, error) {
+	changeLog := getBooleanConfigProperty(definition.SourceConfig, ChangeLog)
+	q, args, err := buildQuery(definition, schema, "", "", "", 0, changeLog)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if from == "" && limit == 0 {
+		// a complete snapshot does not need to be ordered
+		return q, args, nil
+	}
+	return pagedByKey(q, args, entitiesKeyColumn(definition), from, limit)
+}
+
+// pagedByKey wraps the query in one ordered by the key column, starting after the key in the
+// from token
+func pagedByKey(q string, args []any, keyColumn string, from string, limit int) (string, []any, error) {
+	idColumn := quoteIdentifier(keyColumn)
+	q = "SELECT * FROM (" + q + ") AS entities"
+	token, err := decodeEntitiesToken(from)
+	if err != nil {
+		return "", nil, err
+	}
+	if token.After != "" {
+		args = append(args, token.After)
+		q += " WHERE " + idColumn + " > $" + strconv.Itoa(len(args))
+	}
+	q += " ORDER BY " + idColumn
+	if limit != 0 {
+		args = append(args, limit)
+		q += " LIMIT $" + strconv.Itoa(len(args))
+	}
+	return q, args, nil
+}
+
+// decodeEntitiesToken returns the identity an entities page continues after as After, and the
+// since value taken before the first page as Until, if the token has one. The token of the last
+// page only has the since value, see sinceToken.snapshotEnd.
+func decodeEntitiesToken(token string) (*sinceToken, error) {
+	if token == "" {
+		return &sinceToken{}, nil
+	}
+	b, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 0 && b[0] == '{' {
+		st := &sinceToken{}
+		if json.Unmarshal(b, st) == nil && (st.After != "" || st.Until != "") {
+			return &sinceToken{Until: st.Until, After: st.After}, nil
+		}
+	}
+	return &sinceToken{After: string(b)}, nil
+}
+
+// entitiesKeyColumn returns the column used to page through entities, for change log tables
+// this is the column identifying the entity across versions
+func entitiesKeyColumn(definition *cdl.DatasetDefinition) string {
+	if getBooleanConfigProperty(definition.SourceConfig, ChangeLog) {
+		idColumn, _ := changeLogColumns(definition)
+		return idColumn
+	}
+	return identityColumn(definition)
+}
+
+// identityColumn returns the column holding the entity identity, which is the identity property
+// of the outgoing mapping or id if there is none
+func identityColumn(definition *cdl.DatasetDefinition) string {
+	if definition.OutgoingMappingConfig != nil {
+		for _, pm := range definition.OutgoingMappingConfig.PropertyMappings {
+			if pm.IsIdentity {
+				return pm.Property
+			}
+		}
+	}
+	return "id"
+}
+
+// changeLogColumns returns the identity and ordering columns of a change log table. The identity
+// defaults to the identity property of the outgoing mapping.
+func changeLogColumns(definition *cdl.DatasetDefinition) (string, string) {
+	idColumn := getStringConfigProperty(definition.SourceConfig, ChangeLogIdColumn)
+	if idColumn == "" {
+		idColumn = identityColumn(definition)
+	}
+	return idColumn, getStringConfigProperty(definition.SourceConfig, ChangeLogOrderColumn)
+}
+
 type dbIterator struct {
-	logger       cdl.Logger
-	mapper       *cdl.Mapper
-	rows         *sql.Rows
+	logger cdl.Logger
+	mapper *cdl.Mapper
+	rows   *sql.Rows
+	// tx is the transaction the rows are read in when the dataset has timeouts of its own
+	tx           *sql.Tx
+	cancel       context.CancelFunc
 	since        string
 	currentToken string
 	colTypes     []*sql.ColumnType
@@ -328,6 +773,33 @@ type dbIterator struct {
 	limit        int
 	sinceColumn  string
 	entityColumn string
+	// tokenColumn is set when paging by key, the token is then the value of the column in the last row read
+	tokenColumn string
+	lastKey     string
+	// snapshotSince is the since value taken before an entities snapshot, it is the token of the
+	// last page unless endToken is set
+	snapshotSince string
+	endToken      string
+	skipDeleted   bool
+	// keysetSince and keysetTiebreaker are set when a limited page of changes is read, the token of
+	// a full page is then the since value and tie-breaker of its last row
+	keysetSince      string
+	keysetTiebreaker string
+	lastSince        string
+	lastTiebreaker   string
+	// keysetEntity and window are set when a limited page of the latest changes is read, the
+	// token of a full page is then the window with the entity of its last row
+	keysetEntity string
+	window       *sinceToken
+	lastEntity   string
+	rowsRead     int
+	// deletedCol is the lower case column that marks a row as deleted, deletedVal the value
+	// that does so, or empty when any value other than NULL and false does
+	deletedCol string
+	deletedVal string
+	references map[string]bool
+	// relations holds the declared relations by the column their child rows are selected as
+	relations map[string]*relation
 }
 
 func (it *dbIterator) Context() *egdm.Context {
@@ -336,96 +808,297 @@ func (it *dbIterator) Context() *egdm.Context {
 }
 
 func (it *dbIterator) Next() (*egdm.Entity, cdl.LayerError) {
-	if it.rows.Next() {
-		err := it.rows.Scan(it.rowBuf...)
+	for it.rows.Next() {
+		entity, err := it.rowEntity()
 		if err != nil {
-			it.logger.Error("failed to scan row", "error", err)
-			return nil, cdl.Err(err, cdl.LayerErrorInternal)
+			return nil, err
 		}
+		if it.skipDeleted && entity.IsDeleted {
+			continue
+		}
+		return entity, nil
+	}
+
+	// exhausted or failed
+	if it.rows.Err() != nil {
+		it.logger.Error("failed to read rows", "error", it.rows.Err())
+		return nil, cdl.Err(it.rows.Err(), cdl.LayerErrorInternal)
+	}
+	return nil, nil // end of result set
+}
 
-		var entity *egdm.Entity
-		if it.entityColumn == "" {
+// rowEntity scans the current row and maps it to an entity
+func (it *dbIterator) rowEntity() (*egdm.Entity, cdl.LayerError) {
+	err := it.rows.Scan(it.rowBuf...)
+	if err != nil {
+		it.logger.Error("failed to scan row", "error", err)
+		return nil, cdl.Err(err, cdl.LayerErrorInternal)
+	}
 
-			entity = egdm.NewEntity()
-			ri := &RowItem{
-				Columns: it.columns,
-				// Values:  it.rowBuf,
-				Map: make(map[string]any),
+	it.rowsRead++
+	for i, col := range it.columns {
+		switch col {
+		case it.tokenColumn:
+			if v := scannedValue(it.rowBuf[i]); v != nil {
+				it.lastKey = fmt.Sprint(v)
 			}
-			for i, col := range it.columns {
-				ri.Map[strings.ToLower(col)] = it.rowBuf[i]
+		case it.keysetSince:
+			it.lastSince = sinceString(it.rowBuf[i])
+		}
+		if col == it.keysetTiebreaker && col != "" {
+			// rows with a NULL tie-breaker cannot be continued from, and would be skipped or read again
+			if scannedValue(it.rowBuf[i]) == nil {
+				err := fmt.Errorf("tie-breaker column %s must not be NULL to read changes with a limit", col)
+				it.logger.Error("failed to page changes", "error", err)
+				return nil, ErrQuery(err)
 			}
+			it.lastTiebreaker = sinceString(it.rowBuf[i])
+		}
+		if col == it.keysetEntity && col != "" {
+			it.lastEntity = fmt.Sprint(scannedValue(it.rowBuf[i]))
+		}
+	}
+	deleted := it.rowDeleted()
 
-			err = it.mapper.MapItemToEntity(ri, entity)
-			if err != nil {
-				it.logger.Error("failed to map row", "error", err, "row", fmt.Sprintf("%+v", ri))
-				return nil, cdl.Err(err, cdl.LayerErrorInternal)
+	var entity *egdm.Entity
+	if it.entityColumn == "" {
+
+		entity = egdm.NewEntity()
+		ri := &RowItem{
+			// Values:  it.rowBuf,
+			Map:        make(map[string]any),
+			references: it.references,
+		}
+		for i, col := range it.columns {
+			// the deleted expression and tombstone columns are only markers and not properties of the entity
+			if (col == deletedExpressionColumn && it.deletedCol == deletedExpressionColumn) || col == tombstoneMarkerColumn {
+				continue
 			}
-		} else {
-			// read the entity column
-			data := ""
-			for i, col := range it.columns {
-				if col == it.entityColumn {
-					datax, err := json.Marshal(it.rowBuf[i])
-					if err != nil {
-						it.logger.Error("failed to marshal entity column", "error", err)
-						return nil, cdl.Err(err, cdl.LayerErrorInternal)
-					}
-					data = string(datax)
-					break
+			ri.Columns = append(ri.Columns, col)
+			ri.Map[strings.ToLower(col)] = it.rowBuf[i]
+			if rel := it.relations[col]; rel != nil {
+				var data []byte
+				if raw, ok := it.rowBuf[i].(*json.RawMessage); ok {
+					data = *raw
+				}
+				children, err := rel.value(data)
+				if err != nil {
+					it.logger.Error("failed to read child rows", "error", err, "relation", rel.Property)
+					return nil, cdl.Err(err, cdl.LayerErrorInternal)
 				}
+				ri.Map[col] = children
 			}
+		}
 
-			// parse this into an entity
-			parser := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs()
+		err = it.mapper.MapItemToEntity(ri, entity)
+		if err != nil {
+			it.logger.Error("failed to map row", "error", err, "row", fmt.Sprintf("%+v", ri))
+			return nil, cdl.Err(err, cdl.LayerErrorInternal)
+		}
+	} else {
+		// read the entity column
+		data := ""
+		for i, col := range it.columns {
+			if col == it.entityColumn {
+				datax, err := json.Marshal(it.rowBuf[i])
+				if err != nil {
+					it.logger.Error("failed to marshal entity column", "error", err)
+					return nil, cdl.Err(err, cdl.LayerErrorInternal)
+				}
+				data = string(datax)
+				break
+			}
+		}
 
-			// add context to the entity json
-			data = fmt.Sprintf("[{\"id\" : \"@context\", \"namespaces\" : {} }, %s ]", data)
+		// parse this into an entity
+		parser := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs()
 
-			// create a reader from the data varaible
-			datastream := strings.NewReader(data)
+		// add context to the entity json
+		data = fmt.Sprintf("[{\"id\" : \"@context\", \"namespaces\" : {} }, %s ]", data)
 
-			err = parser.Parse(datastream, func(ent *egdm.Entity) error {
-				entity = ent
-				return nil
-			}, func(continuation *egdm.Continuation) {
+		// create a reader from the data varaible
+		datastream := strings.NewReader(data)
 
-			})
+		err = parser.Parse(datastream, func(ent *egdm.Entity) error {
+			entity = ent
+			return nil
+		}, func(continuation *egdm.Continuation) {
 
-			if err != nil {
-				it.logger.Error("failed to parse entity", "error", err)
-				return nil, cdl.Err(err, cdl.LayerErrorInternal)
-			}
+		})
 
-			if entity == nil {
-				it.logger.Error("failed to parse entity", "error", "no entity")
-				return nil, cdl.Err(fmt.Errorf("no entity"), cdl.LayerErrorInternal)
-			}
+		if err != nil {
+			it.logger.Error("failed to parse entity", "error", err)
+			return nil, cdl.Err(err, cdl.LayerErrorInternal)
+		}
 
+		if entity == nil {
+			it.logger.Error("failed to parse entity", "error", "no entity")
+			return nil, cdl.Err(fmt.Errorf("no entity"), cdl.LayerErrorInternal)
 		}
 
-		return entity, nil
+	}
 
-	} else {
-		// exhausted or failed
-		if it.rows.Err() != nil {
-			it.logger.Error("failed to read rows", "error", it.rows.Err())
-			return nil, cdl.Err(it.rows.Err(), cdl.LayerErrorInternal)
+	if deleted {
+		entity.IsDeleted = true
+	}
+	return entity, nil
+}
+
+// rowDeleted reports whether the current row is a tombstone or marked as deleted by the deleted column
+func (it *dbIterator) rowDeleted() bool {
+	for i, col := range it.columns {
+		switch {
+		case col == tombstoneMarkerColumn:
+			if isDeletedValue(it.rowBuf[i], "") {
+				return true
+			}
+		case col == it.deletedCol && col != "":
+			if isDeletedValue(it.rowBuf[i], it.deletedVal) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isDeletedValue(v any, deletedVal string) bool {
+	if t, ok := v.(*sql.NullTime); ok {
+		if !t.Valid {
+			return false
 		}
-		return nil, nil // end of result set
+		return deletedVal == "" || t.Time.Format(sinceTimeFormat) == deletedVal
+	}
+	val := scannedValue(v)
+	if deletedVal != "" {
+		return val != nil && fmt.Sprint(val) == deletedVal
+	}
+	switch b := val.(type) {
+	case nil:
+		return false
+	case bool:
+		return b
+	case string:
+		return b != "" && b != "false"
+	case int64:
+		return b != 0
+	}
+	return true
+}
+
+// deletedMarker returns the lower case column and value that mark a row as deleted
+func deletedMarker(definition *cdl.DatasetDefinition) (string, string) {
+	if getStringConfigProperty(definition.SourceConfig, DeletedExpression) != "" {
+		return deletedExpressionColumn, ""
+	}
+	col := getStringConfigProperty(definition.SourceConfig, DeletedColumn)
+	if col == "" {
+		return "", ""
 	}
+	val := ""
+	if v, ok := definition.SourceConfig[DeletedValue]; ok && v != nil {
+		val = fmt.Sprint(v)
+	}
+	return columnKey(col), val
 }
 
 func (it *dbIterator) Token() (*egdm.Continuation, cdl.LayerError) {
 	cont := egdm.NewContinuation()
-	if it.currentToken != "" {
+	if it.keysetSince != "" && it.rowsRead >= it.limit && it.lastSince != "" {
+		// the page is full, so there may be more rows up to the max since value
+		cont.Token = encodeSinceToken(it.lastSince, it.lastTiebreaker)
+	} else if it.keysetEntity != "" && it.rowsRead >= it.limit && it.lastEntity != "" {
+		// the page is full, so there may be more entities changed within the window
+		cont.Token = (&sinceToken{Since: it.window.Since, Until: it.window.Until, After: it.lastEntity}).encode()
+	} else if it.tokenColumn != "" || it.snapshotSince != "" {
+		cont.Token = it.keyToken()
+	} else if it.currentToken != "" {
 		cont.Token = it.currentToken
 	}
 	return cont, nil
 }
 
+// selectedOnce fails unless each of the columns is in the result exactly once
+func (it *dbIterator) selectedOnce(columns ...string) error {
+	for _, col := range columns {
+		n := 0
+		for _, c := range it.columns {
+			if c == col {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("column %s must be selected once to read changes with a limit, found %d", col, n)
+		}
+	}
+	return nil
+}
+
+// keyToken returns the token of an entities page. The last page of a snapshot returns the
+// since token taken before it, other pages read by key the key of their last row.
+func (it *dbIterator) keyToken() string {
+	full := it.limit != 0 && it.rowsRead >= it.limit
+	switch {
+	case it.snapshotSince != "" && !full && it.endToken != "":
+		return it.endToken
+	case it.snapshotSince != "" && !full:
+		return (&sinceToken{Until: it.snapshotSince}).encode()
+	case it.snapshotSince != "" && it.lastKey != "":
+		return (&sinceToken{Until: it.snapshotSince, After: it.lastKey}).encode()
+	case it.lastKey != "":
+		return base64.URLEncoding.EncodeToString([]byte(it.lastKey))
+	}
+	return it.currentToken
+}
+
+// snapshotEndIterator is the empty page read with the token of the last page of an entities
+// snapshot, it hands the token on
+type snapshotEndIterator struct {
+	token string
+}
+
+func (it *snapshotEndIterator) Context() *egdm.Context {
+	return egdm.NewNamespaceContext().AsContext()
+}
+
+func (it *snapshotEndIterator) Next() (*egdm.Entity, cdl.LayerError) {
+	return nil, nil
+}
+
+func (it *snapshotEndIterator) Token() (*egdm.Continuation, cdl.LayerError) {
+	cont := egdm.NewContinuation()
+	cont.Token = it.token
+	return cont, nil
+}
+
+func (it *snapshotEndIterator) Close() cdl.LayerError {
+	return nil
+}
+
+// sinceString formats a scanned since value the same way as the max since value of a token
+func sinceString(v any) string {
+	if t, ok := v.(*sql.NullTime); ok {
+		if !t.Valid {
+			return ""
+		}
+		return t.Time.Format(sinceTimeFormat)
+	}
+	val := scannedValue(v)
+	if val == nil {
+		return ""
+	}
+	return fmt.Sprint(val)
+}
+
 func (it *dbIterator) Close() cdl.LayerError {
 	err := it.rows.Close()
+	if it.tx != nil {
+		if cerr := it.tx.Commit(); err == nil && cerr != sql.ErrTxDone {
+			err = cerr
+		}
+	}
+	if it.cancel != nil {
+		it.cancel()
+	}
 	if err != nil {
 		return cdl.Err(err, cdl.LayerErrorInternal)
 	}
@@ -0,0 +1,619 @@
+package layer
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+func testDefinition(sourceConfig map[string]any) *cdl.DatasetDefinition {
+	return &cdl.DatasetDefinition{
+		DatasetName:  "products",
+		SourceConfig: sourceConfig,
+		OutgoingMappingConfig: &cdl.OutgoingMappingConfig{
+			PropertyMappings: []*cdl.ItemToEntityPropertyMapping{
+				{Property: "id", IsIdentity: true},
+				{Property: "name"},
+			},
+		},
+	}
+}
+
+func TestBuildQuery(t *testing.T) {
+	token := func(s string) string { return base64.URLEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name          string
+		sourceConfig  map[string]any
+		since         string
+		maxSince      string
+		sinceDatatype string
+		limit         int
+		latestOnly    bool
+		query         string
+		args          []any
+	}{
+		{
+			name:         "no since column",
+			sourceConfig: map[string]any{TableName: "product"},
+			query:        "SELECT \"id\", \"name\" FROM \"product\"",
+		},
+		{
+			name:          "initial int since with limit",
+			sourceConfig:  map[string]any{TableName: "product", SinceColumn: "seq"},
+			maxSince:      "10",
+			sinceDatatype: "int",
+			limit:         5,
+			query:         `SELECT "id", "name", "seq" FROM "product" WHERE "product"."seq" <= $1 ORDER BY "product"."seq", "product"."id" LIMIT $2`,
+			args:          []any{int64(10), 5},
+		},
+		{
+			name:          "compound since token with limit",
+			sourceConfig:  map[string]any{TableName: "product", SinceColumn: "seq"},
+			since:         encodeSinceToken("3", "abc"),
+			maxSince:      "10",
+			sinceDatatype: "int",
+			limit:         5,
+			query:         `SELECT "id", "name", "seq" FROM "product" WHERE ("product"."seq", "product"."id") > ($1, $2) AND "product"."seq" <= $3 ORDER BY "product"."seq", "product"."id" LIMIT $4`,
+			args:          []any{int64(3), "abc", int64(10), 5},
+		},
+		{
+			name:          "compound since token without limit",
+			sourceConfig:  map[string]any{TableName: "product", SinceColumn: "seq"},
+			since:         encodeSinceToken("3", "abc"),
+			maxSince:      "10",
+			sinceDatatype: "int",
+			query:         `SELECT "id", "name" FROM "product" WHERE ("product"."seq", "product"."id") > ($1, $2) AND "product"."seq" <= $3`,
+			args:          []any{int64(3), "abc", int64(10)},
+		},
+		{
+			name:          "int since token",
+			sourceConfig:  map[string]any{TableName: "product", SinceColumn: "seq"},
+			since:         token("3"),
+			maxSince:      "10",
+			sinceDatatype: "int",
+			query:         `SELECT "id", "name" FROM "product" WHERE "product"."seq" > $1 AND "product"."seq" <= $2`,
+			args:          []any{int64(3), int64(10)},
+		},
+		{
+			name:          "time since token",
+			sourceConfig:  map[string]any{TableName: "product", SinceColumn: "ts"},
+			since:         token("2024-01-01 10:00:00.000000"),
+			maxSince:      "2024-02-01 10:00:00.000000",
+			sinceDatatype: "time",
+			query:         `SELECT "id", "name" FROM "product" WHERE "product"."ts" > $1::timestamp AND "product"."ts" <= $2::timestamp`,
+			args:          []any{"2024-01-01 10:00:00.000000", "2024-02-01 10:00:00.000000"},
+		},
+		{
+			name:          "string token with quotes is passed as argument",
+			sourceConfig:  map[string]any{TableName: "product", SinceColumn: "code"},
+			since:         token("x' OR '1'='1"),
+			maxSince:      "z",
+			sinceDatatype: "string",
+			query:         `SELECT "id", "name" FROM "product" WHERE "product"."code" > $1 AND "product"."code" <= $2`,
+			args:          []any{"x' OR '1'='1", "z"},
+		},
+		{
+			name: "data query with since table",
+			sourceConfig: map[string]any{
+				DataQuery:   "SELECT * FROM product p JOIN price ON p.id = price.product WHERE price.active",
+				SinceTable:  "price",
+				SinceColumn: "seq",
+			},
+			since:         token("1.5"),
+			maxSince:      "2.5",
+			sinceDatatype: "float",
+			query:         `SELECT * FROM product p JOIN price ON p.id = price.product WHERE price.active AND "price"."seq" > $1 AND "price"."seq" <= $2`,
+			args:          []any{1.5, 2.5},
+		},
+		{
+			name: "data query with since table and limit",
+			sourceConfig: map[string]any{
+				DataQuery:   "SELECT price.id, p.name, price.seq FROM product p JOIN price ON p.id = price.product",
+				SinceTable:  "price",
+				SinceColumn: "seq",
+			},
+			since:         encodeSinceToken("1.5", "7"),
+			maxSince:      "2.5",
+			sinceDatatype: "float",
+			limit:         10,
+			query:         `SELECT price.id, p.name, price.seq FROM product p JOIN price ON p.id = price.product WHERE ("price"."seq", "price"."id") > ($1, $2) AND "price"."seq" <= $3 ORDER BY "price"."seq", "price"."id" LIMIT $4`,
+			args:          []any{1.5, "7", 2.5, 10},
+		},
+		{
+			name: "latest only from change log",
+			sourceConfig: map[string]any{
+				TableName:            "product_log",
+				SinceColumn:          "seq",
+				ChangeLog:            true,
+				ChangeLogOrderColumn: "version",
+			},
+			since:         token("3"),
+			maxSince:      "10",
+			sinceDatatype: "int",
+			limit:         100,
+			latestOnly:    true,
+			query:         `SELECT DISTINCT ON ("id") * FROM (SELECT "id", "name", "version" FROM "product_log" WHERE "product_log"."seq" > $1 AND "product_log"."seq" <= $2) AS changes ORDER BY "id", "version" DESC NULLS LAST LIMIT $3`,
+			args:          []any{int64(3), int64(10), 100},
+		},
+		{
+			name: "latest only page after an entity",
+			sourceConfig: map[string]any{
+				TableName:            "product_log",
+				SinceColumn:          "seq",
+				ChangeLog:            true,
+				ChangeLogOrderColumn: "version",
+			},
+			since:         (&sinceToken{Since: "3", Until: "10", After: "42"}).encode(),
+			maxSince:      "10",
+			sinceDatatype: "int",
+			limit:         100,
+			latestOnly:    true,
+			query:         `SELECT DISTINCT ON ("id") * FROM (SELECT "id", "name", "version" FROM "product_log" WHERE "product_log"."seq" > $1 AND "product_log"."seq" <= $2) AS changes WHERE "id" > $3 ORDER BY "id", "version" DESC NULLS LAST LIMIT $4`,
+			args:          []any{int64(3), int64(10), "42", 100},
+		},
+		{
+			name: "latest only with tombstones",
+			sourceConfig: map[string]any{
+				TableName:            "product_log",
+				SinceColumn:          "seq",
+				TombstoneTable:       "product_log_tombstone",
+				ChangeLog:            true,
+				ChangeLogOrderColumn: "version",
+			},
+			maxSince:      "10",
+			sinceDatatype: "int",
+			latestOnly:    true,
+			query: `SELECT DISTINCT ON ("id") * FROM (SELECT * FROM (SELECT "id", "name", "version", "seq", FALSE AS _tombstone FROM "product_log" UNION ALL SELECT "id", "name", "version", "seq", TRUE FROM ` +
+				`(SELECT (jsonb_populate_record(NULL::"product_log", jsonb_build_object('id', t."id", 'seq', t."deleted_at"))).* FROM "product_log_tombstone" t ` +
+				`WHERE NOT EXISTS (SELECT 1 FROM "product_log" l WHERE l."id" = t."id")) AS "product_log") AS "product_log" WHERE "product_log"."seq" <= $1) AS changes ` +
+				`ORDER BY "id", "version" DESC NULLS LAST`,
+			args: []any{int64(10)},
+		},
+		{
+			name:         "deleted column is selected",
+			sourceConfig: map[string]any{TableName: "product", DeletedColumn: "removed"},
+			query:        `SELECT "id", "name", "removed" FROM "product"`,
+		},
+		{
+			name:         "deleted expression",
+			sourceConfig: map[string]any{TableName: "product", DeletedExpression: "removed_at IS NOT NULL"},
+			query:        `SELECT "id", "name", (removed_at IS NOT NULL) AS _deleted FROM "product"`,
+		},
+		{
+			name:          "tombstone table",
+			sourceConfig:  map[string]any{TableName: "public.product", SinceColumn: "seq", TombstoneTable: "public.product_tombstone"},
+			since:         token("3"),
+			maxSince:      "10",
+			sinceDatatype: "int",
+			query: `SELECT * FROM (SELECT "id", "name", "seq", FALSE AS _tombstone FROM "public"."product" UNION ALL SELECT "id", "name", "seq", TRUE FROM ` +
+				`(SELECT (jsonb_populate_record(NULL::"public"."product", jsonb_build_object('id', t."id", 'seq', t."deleted_at"))).* FROM "public"."product_tombstone" t ` +
+				`WHERE NOT EXISTS (SELECT 1 FROM "public"."product" l WHERE l."id" = t."id")) AS "product") AS "product" WHERE "product"."seq" > $1 AND "product"."seq" <= $2`,
+			args: []any{int64(3), int64(10)},
+		},
+		{
+			name: "relations",
+			sourceConfig: map[string]any{TableName: "product", Relations: []any{
+				map[string]any{"property": "parts", "table": "part", "foreign_key": "product_id", "order_by": "pos"},
+				map[string]any{"property": "maker", "table": "maker", "foreign_key": "id", "key": "maker_id", "single": true},
+			}},
+			query: `SELECT "id", "name", (SELECT json_agg(c ORDER BY c."pos") FROM "part" c WHERE c."product_id" = "product"."id") AS "parts", ` +
+				`(SELECT row_to_json(c) FROM "maker" c WHERE c."id" = "product"."maker_id" LIMIT 1) AS "maker" FROM "product"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, args, err := buildQuery(testDefinition(tt.sourceConfig), "", tt.since, tt.maxSince, tt.sinceDatatype, tt.limit, tt.latestOnly)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q != tt.query {
+				t.Errorf("unexpected query\n got: %s\nwant: %s", q, tt.query)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("unexpected args: got %#v, want %#v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestIsDeletedValue(t *testing.T) {
+	tests := []struct {
+		val        any
+		deletedVal string
+		deleted    bool
+	}{
+		{&sql.NullBool{Bool: true, Valid: true}, "", true},
+		{&sql.NullBool{Bool: false, Valid: true}, "", false},
+		{&sql.NullString{}, "", false},
+		{&sql.NullString{String: "D", Valid: true}, "D", true},
+		{&sql.NullString{String: "A", Valid: true}, "D", false},
+		{&sql.NullInt64{Int64: 1, Valid: true}, "1", true},
+		{&sql.NullInt64{Int64: 0, Valid: true}, "", false},
+		{&sql.NullTime{Time: time.Now(), Valid: true}, "", true},
+		{&sql.NullTime{}, "", false},
+		{"true", "", true},
+	}
+	for i, tt := range tests {
+		if isDeletedValue(tt.val, tt.deletedVal) != tt.deleted {
+			t.Errorf("case %d: expected deleted %v for %#v", i, tt.deleted, tt.val)
+		}
+	}
+}
+
+func TestBuildQueryRejectsInvalidToken(t *testing.T) {
+	def := testDefinition(map[string]any{TableName: "product", SinceColumn: "seq"})
+	since := base64.URLEncoding.EncodeToString([]byte("1; DROP TABLE product"))
+	if _, _, err := buildQuery(def, "", since, "10", "int", 0, false); err == nil {
+		t.Fatal("expected error for non numeric int token")
+	}
+}
+
+func TestBuildEntitiesQuery(t *testing.T) {
+	def := testDefinition(map[string]any{TableName: "product", SinceColumn: "seq"})
+
+	q, args, err := buildEntitiesQuery(def, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q != `SELECT "id", "name" FROM "product"` || len(args) != 0 {
+		t.Errorf("unexpected snapshot query %s %v", q, args)
+	}
+
+	from := base64.URLEncoding.EncodeToString([]byte("42"))
+	q, args, err = buildEntitiesQuery(def, "", from, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `SELECT * FROM (SELECT "id", "name" FROM "product") AS entities WHERE "id" > $1 ORDER BY "id" LIMIT $2`
+	if q != expected {
+		t.Errorf("unexpected query\n got: %s\nwant: %s", q, expected)
+	}
+	if !reflect.DeepEqual(args, []any{"42", 10}) {
+		t.Errorf("unexpected args %#v", args)
+	}
+}
+
+func TestEntitiesToken(t *testing.T) {
+	token := func(s string) string { return base64.URLEncoding.EncodeToString([]byte(s)) }
+
+	// a full page continues after its last row, and hands on the since value of the snapshot
+	it := &dbIterator{tokenColumn: "id", limit: 2, rowsRead: 2, lastKey: "42", snapshotSince: "10"}
+	st, err := decodeEntitiesToken(it.keyToken())
+	if err != nil || st.After != "42" || st.Until != "10" || st.snapshotEnd() {
+		t.Errorf("expected a token after 42 of the snapshot at 10, got %+v %v", st, err)
+	}
+
+	// the last page returns the since token of the changes from before the snapshot, which
+	// cannot be taken for the key of a row
+	it.rowsRead = 1
+	if st, _ = decodeEntitiesToken(it.keyToken()); !st.snapshotEnd() || st.Until != "10" {
+		t.Errorf("expected the since token of the snapshot, got %+v", st)
+	}
+	end := &Dataset{
+		logger:            cdl.NewLogger("test", "text", "info"),
+		datasetDefinition: testDefinition(map[string]any{TableName: "product", SinceColumn: "seq", SinceDatatype: "int"}),
+	}
+	iter, lerr := end.entities(it.keyToken(), 2)
+	if lerr != nil {
+		t.Fatal(lerr)
+	}
+	if entity, _ := iter.Next(); entity != nil {
+		t.Errorf("expected an empty page for the token of the last page, got %v", entity)
+	}
+	if cont, _ := iter.Token(); cont.Token != it.keyToken() {
+		t.Errorf("expected the since token to be handed on, got %s", cont.Token)
+	}
+	q, args, err := buildQuery(testDefinition(map[string]any{TableName: "product", SinceColumn: "seq"}), "", it.keyToken(), "12", "int", 0, false)
+	if err != nil || !reflect.DeepEqual(args, []any{int64(10), int64(12)}) {
+		t.Errorf("expected the changes after the snapshot, got %s %v %v", q, args, err)
+	}
+
+	// datasets without since column page by key only
+	it = &dbIterator{tokenColumn: "id", limit: 2, rowsRead: 1, lastKey: "42"}
+	if got := it.keyToken(); got != token("42") {
+		t.Errorf("expected the key of the last row, got %s", got)
+	}
+	if st, _ = decodeEntitiesToken(token("42")); st.After != "42" || st.Until != "" {
+		t.Errorf("expected a plain key token, got %+v", st)
+	}
+
+	// a complete snapshot is not ordered by key, its token is the since value taken before it
+	log := &changeLogConnector{rows: [][4]int64{{2, 1, 0, 12}, {1, 1, 0, 11}}}
+	snapshot := &Dataset{
+		logger: cdl.NewLogger("test", "text", "info"),
+		db:     &pgsqlDB{db: sql.OpenDB(log)},
+		datasetDefinition: &cdl.DatasetDefinition{
+			DatasetName:  "product_log",
+			SourceConfig: map[string]any{TableName: "product_log", SinceColumn: "seq", SinceDatatype: "int"},
+			OutgoingMappingConfig: &cdl.OutgoingMappingConfig{
+				BaseURI:          "http://data.sample.org/",
+				PropertyMappings: []*cdl.ItemToEntityPropertyMapping{{Property: "id", IsIdentity: true, URIValuePattern: "http://data.sample.org/{value}"}},
+			},
+		},
+	}
+	iter, lerr = snapshot.entities("", 0)
+	if lerr != nil {
+		t.Fatal(lerr)
+	}
+	for entity, _ := iter.Next(); entity != nil; entity, _ = iter.Next() {
+	}
+	cont, _ := iter.Token()
+	if st, _ = decodeEntitiesToken(cont.Token); !st.snapshotEnd() || st.Until != "12" {
+		t.Errorf("expected the since token of the snapshot, got %+v", st)
+	}
+
+	// without since column there is no token to continue from
+	snapshot.datasetDefinition.SourceConfig = map[string]any{TableName: "product_log"}
+	iter, lerr = snapshot.entities("", 0)
+	if lerr != nil {
+		t.Fatal(lerr)
+	}
+	for entity, _ := iter.Next(); entity != nil; entity, _ = iter.Next() {
+	}
+	if cont, _ = iter.Token(); cont.Token != "" {
+		t.Errorf("expected no token for an unordered snapshot, got %s", cont.Token)
+	}
+}
+
+func TestLimitedChangesRequireKeysetColumns(t *testing.T) {
+	log := &changeLogConnector{rows: [][4]int64{{1, 1, 0, 1}}}
+	d := &Dataset{
+		logger: cdl.NewLogger("test", "text", "info"),
+		db:     &pgsqlDB{db: sql.OpenDB(log)},
+		datasetDefinition: testDefinition(map[string]any{
+			DataQuery: "SELECT id, name, version FROM product_log", SinceTable: "product_log", SinceColumn: "seq", SinceDatatype: "int",
+		}),
+	}
+	// the data query does not select the since column, a token of a full page could not be made
+	if _, err := d.changes("", 1, false); err == nil || !strings.Contains(err.Error(), "column seq must be selected once") {
+		t.Fatalf("expected the read to fail, got %v", err)
+	}
+}
+
+func TestChangesTokenWithTimeTiebreaker(t *testing.T) {
+	changed := time.Date(2024, 2, 1, 10, 0, 0, 500000000, time.UTC)
+	rows := &changeLogRows{
+		columns: []string{"id", "seq", "changed"},
+		values:  [][]driver.Value{{int64(1), int64(5), changed}, {int64(2), int64(5), nil}},
+		times:   map[string]bool{"changed": true},
+	}
+	definition := testDefinition(map[string]any{TableName: "product", SinceColumn: "seq", SinceDatatype: "int", TiebreakerColumn: "changed"})
+	definition.OutgoingMappingConfig.PropertyMappings[0].URIValuePattern = "http://data.sample.org/{value}"
+	d := &Dataset{
+		logger:            cdl.NewLogger("test", "text", "info"),
+		db:                &pgsqlDB{db: sql.OpenDB(&staticConnector{result: rows})},
+		datasetDefinition: definition,
+	}
+	mapper := cdl.NewMapper(d.logger, nil, definition.OutgoingMappingConfig)
+	iter, lerr := d.queryIterator(context.Background(), d.db, mapper, "", nil, "", 1, "")
+	if lerr != nil {
+		t.Fatal(lerr)
+	}
+	iter.keysetSince, iter.keysetTiebreaker = "seq", "changed"
+	if _, lerr = iter.Next(); lerr != nil {
+		t.Fatal(lerr)
+	}
+
+	// the tie-breaker is handed on in the format of time since values, and bound as is
+	cont, _ := iter.Token()
+	token, err := decodeSinceToken(cont.Token)
+	if err != nil || token.Since != "5" || token.Tiebreaker != "2024-02-01 10:00:00.500000" {
+		t.Fatalf("expected a token after 5 and the time of the row, got %+v %v", token, err)
+	}
+	_, args, err := buildQuery(definition, "", cont.Token, "10", "int", 1, false)
+	if err != nil || !reflect.DeepEqual(args, []any{int64(5), "2024-02-01 10:00:00.500000", int64(10), 1}) {
+		t.Errorf("expected the tie-breaker of the token as argument, got %v %v", args, err)
+	}
+
+	// a NULL tie-breaker cannot be continued from
+	iter.rowsRead = 0
+	if _, lerr = iter.Next(); lerr == nil || !strings.Contains(lerr.Error(), "must not be NULL") {
+		t.Errorf("expected the row with a NULL tie-breaker to fail, got %v", lerr)
+	}
+}
+
+// staticConnector answers every query with the same rows
+type staticConnector struct {
+	changeLogConnector
+	result *changeLogRows
+}
+
+func (c *staticConnector) Connect(context.Context) (driver.Conn, error) { return c, nil }
+func (c *staticConnector) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return c.result, nil
+}
+
+// changeLogConnector serves the queries of a change log dataset with id, name, version and seq
+// columns from memory, see TestLatestChangesPaging
+type changeLogConnector struct {
+	rows [][4]int64
+}
+
+func (c *changeLogConnector) Connect(context.Context) (driver.Conn, error) { return c, nil }
+func (c *changeLogConnector) Driver() driver.Driver                        { return nil }
+func (c *changeLogConnector) Prepare(string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (c *changeLogConnector) Close() error              { return nil }
+func (c *changeLogConnector) Begin() (driver.Tx, error) { return nil, fmt.Errorf("not supported") }
+
+// QueryContext answers the max since query, the latest changes query of buildQuery and queries
+// of the complete table
+func (c *changeLogConnector) QueryContext(_ context.Context, query string, named []driver.NamedValue) (driver.Rows, error) {
+	if strings.Contains(query, "MAX(") {
+		var maxSeq int64
+		for _, r := range c.rows {
+			maxSeq = max(maxSeq, r[3])
+		}
+		return &changeLogRows{columns: []string{"_MAX_SINCE"}, values: [][]driver.Value{{maxSeq}}}, nil
+	}
+	if len(named) == 0 {
+		// a complete read of the table, in the order the rows were logged
+		result := &changeLogRows{columns: []string{"id", "name", "version"}}
+		for _, r := range c.rows {
+			result.values = append(result.values, []driver.Value{r[0], fmt.Sprintf("product %d", r[0]), r[1]})
+		}
+		return result, nil
+	}
+	args := make([]any, len(named))
+	for i, a := range named {
+		args[i] = a.Value
+	}
+	next := func() any {
+		v := args[0]
+		args = args[1:]
+		return v
+	}
+	var lower, after int64 = 0, -1
+	if strings.Contains(query, `"seq" > $`) {
+		lower = next().(int64)
+	}
+	upper := next().(int64)
+	if strings.Contains(query, `"id" > $`) {
+		after, _ = strconv.ParseInt(next().(string), 10, 64)
+	}
+	limit := next().(int64)
+
+	latest := map[int64][4]int64{}
+	for _, r := range c.rows {
+		if r[3] > lower && r[3] <= upper && r[0] > after && r[1] >= latest[r[0]][1] {
+			latest[r[0]] = r
+		}
+	}
+	result := &changeLogRows{columns: []string{"id", "name", "version"}}
+	for _, r := range latest {
+		result.values = append(result.values, []driver.Value{r[0], fmt.Sprintf("product %d", r[0]), r[1]})
+	}
+	sort.Slice(result.values, func(i, j int) bool { return result.values[i][0].(int64) < result.values[j][0].(int64) })
+	if int64(len(result.values)) > limit {
+		result.values = result.values[:limit]
+	}
+	return result, nil
+}
+
+type changeLogRows struct {
+	columns []string
+	values  [][]driver.Value
+	// times are the columns of time values
+	times map[string]bool
+}
+
+func (r *changeLogRows) Columns() []string { return r.columns }
+func (r *changeLogRows) Close() error      { return nil }
+func (r *changeLogRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+func (r *changeLogRows) ColumnTypeScanType(i int) reflect.Type {
+	if r.times[r.columns[i]] {
+		return reflect.TypeOf(time.Time{})
+	}
+	if r.columns[i] == "name" {
+		return reflect.TypeOf("")
+	}
+	return reflect.TypeOf(int64(0))
+}
+func (r *changeLogRows) ColumnTypeDatabaseTypeName(i int) string {
+	if r.times[r.columns[i]] {
+		return "TIMESTAMPTZ"
+	}
+	if r.columns[i] == "name" {
+		return "TEXT"
+	}
+	return "INT8"
+}
+
+func TestLatestChangesPaging(t *testing.T) {
+	// 7 entities with two versions each, more than fit on one page
+	log := &changeLogConnector{}
+	for seq := int64(1); seq <= 14; seq++ {
+		log.rows = append(log.rows, [4]int64{(seq-1)%7 + 1, (seq-1)/7 + 1, 0, seq})
+	}
+	d := &Dataset{
+		logger: cdl.NewLogger("test", "text", "info"),
+		db:     &pgsqlDB{db: sql.OpenDB(log)},
+		datasetDefinition: &cdl.DatasetDefinition{
+			DatasetName: "product_log",
+			SourceConfig: map[string]any{
+				TableName: "product_log", SinceColumn: "seq", SinceDatatype: "int", ChangeLog: true, ChangeLogOrderColumn: "version",
+			},
+			OutgoingMappingConfig: &cdl.OutgoingMappingConfig{
+				BaseURI: "http://data.sample.org/",
+				PropertyMappings: []*cdl.ItemToEntityPropertyMapping{
+					{Property: "id", IsIdentity: true, URIValuePattern: "http://data.sample.org/{value}"},
+					{Property: "version", EntityProperty: "version"},
+				},
+			},
+		},
+	}
+
+	read := func(since string) ([]string, string) {
+		t.Helper()
+		iter, err := d.changes(since, 3, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer iter.Close()
+		var ids []string
+		for {
+			entity, err := iter.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entity == nil {
+				break
+			}
+			if v := entity.Properties["http://data.sample.org/version"]; v != int64(2) {
+				t.Errorf("expected the latest version of %s, got %v", entity.ID, v)
+			}
+			ids = append(ids, entity.ID)
+		}
+		token, err := iter.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids, token.Token
+	}
+
+	var seen []string
+	ids, token := read("")
+	seen = append(seen, ids...)
+	// changes made while paging are read after the window of the first page
+	log.rows = append(log.rows, [4]int64{8, 2, 0, 15})
+	for len(ids) == 3 {
+		ids, token = read(token)
+		seen = append(seen, ids...)
+	}
+	expected := []string{"1", "2", "3", "4", "5", "6", "7"}
+	for i := range expected {
+		expected[i] = "http://data.sample.org/" + expected[i]
+	}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Fatalf("expected every entity once, got %v", seen)
+	}
+
+	ids, token = read(token)
+	if !reflect.DeepEqual(ids, []string{"http://data.sample.org/8"}) {
+		t.Fatalf("expected the entity changed while paging, got %v", ids)
+	}
+	if ids, _ = read(token); len(ids) != 0 {
+		t.Fatalf("expected no more changes, got %v", ids)
+	}
+}
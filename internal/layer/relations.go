@@ -0,0 +1,296 @@
+package layer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+// relation declares a child table whose rows are embedded in the entities of a dataset.
+// On read the child rows are selected as a JSON column named after the property, and are
+// emitted as a list of objects, or as sub-entities when an id column and uri value pattern
+// are given. On write the property value is written back into the child table, see
+// childStatements. Key and BaseURI default to the identity column and base uri of the
+// outgoing or incoming mapping, depending on the direction.
+type relation struct {
+	Property        string `json:"property"`
+	Table           string `json:"table"`
+	ForeignKey      string `json:"foreign_key"`
+	Key             string `json:"key"`
+	OrderBy         string `json:"order_by"`
+	Single          bool   `json:"single"`
+	IdColumn        string `json:"id_column"`
+	URIValuePattern string `json:"uri_value_pattern"`
+	BaseURI         string `json:"base_uri"`
+}
+
+// datasetRelations returns the relations declared in the source config of the dataset
+func datasetRelations(definition *cdl.DatasetDefinition) ([]*relation, error) {
+	raw, ok := definition.SourceConfig[Relations]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var rels []*relation
+	err = json.Unmarshal(data, &rels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relations in dataset %s: %w", definition.DatasetName, err)
+	}
+
+	for _, rel := range rels {
+		if rel.Property == "" || rel.Table == "" || rel.ForeignKey == "" {
+			return nil, fmt.Errorf("relations in dataset %s require property, table and foreign_key", definition.DatasetName)
+		}
+		if (rel.IdColumn == "") != (rel.URIValuePattern == "") {
+			return nil, fmt.Errorf("relation %s in dataset %s requires both id_column and uri_value_pattern for sub-entities", rel.Property, definition.DatasetName)
+		}
+		rel.Property = columnKey(rel.Property)
+	}
+	return rels, nil
+}
+
+// outgoingRelations returns the relations of the dataset with the defaults of the outgoing mapping
+func outgoingRelations(definition *cdl.DatasetDefinition) ([]*relation, error) {
+	rels, err := datasetRelations(definition)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range rels {
+		if rel.Key == "" {
+			rel.Key = identityColumn(definition)
+		}
+		if rel.BaseURI == "" && definition.OutgoingMappingConfig != nil {
+			rel.BaseURI = definition.OutgoingMappingConfig.BaseURI
+		}
+	}
+	return rels, nil
+}
+
+// selectExpr returns the subquery selecting the child rows of the parent table as JSON. The
+// child table is qualified with the schema unless it has a schema of its own.
+func (r *relation) selectExpr(parentTable string, schema string) string {
+	cond := " FROM " + tableRef(schema, r.Table) + " c WHERE c." + quoteIdentifier(r.ForeignKey) + " = " + parentTable + "." + quoteIdentifier(r.Key)
+	if r.Single {
+		q := "(SELECT row_to_json(c)" + cond
+		if r.OrderBy != "" {
+			q += " ORDER BY c." + quoteIdentifier(r.OrderBy)
+		}
+		return q + " LIMIT 1) AS " + quoteIdentifier(r.Property)
+	}
+	agg := "json_agg(c"
+	if r.OrderBy != "" {
+		agg += " ORDER BY c." + quoteIdentifier(r.OrderBy)
+	}
+	return "(SELECT " + agg + ")" + cond + ") AS " + quoteIdentifier(r.Property)
+}
+
+// value converts the JSON of the child rows into the property value
+func (r *relation) value(data []byte) (any, error) {
+	if len(data) == 0 || string(data) == "null" {
+		if r.Single {
+			return nil, nil
+		}
+		return []any{}, nil
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	if r.Single {
+		var row map[string]any
+		if err := dec.Decode(&row); err != nil {
+			return nil, err
+		}
+		return r.child(row)
+	}
+
+	var rows []map[string]any
+	if err := dec.Decode(&rows); err != nil {
+		return nil, err
+	}
+	if r.IdColumn != "" {
+		entities := make([]*egdm.Entity, 0, len(rows))
+		for _, row := range rows {
+			e, err := r.child(row)
+			if err != nil {
+				return nil, err
+			}
+			entities = append(entities, e.(*egdm.Entity))
+		}
+		return entities, nil
+	}
+	list := make([]any, 0, len(rows))
+	for _, row := range rows {
+		c, err := r.child(row)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+// child converts a child row into an object, or a sub-entity when an id column is declared
+func (r *relation) child(row map[string]any) (any, error) {
+	for k, v := range row {
+		if n, ok := v.(json.Number); ok {
+			row[k] = numberValue(n)
+		}
+	}
+	if r.IdColumn == "" {
+		return row, nil
+	}
+
+	id, ok := row[identifierName(r.IdColumn)]
+	if !ok || id == nil {
+		return nil, fmt.Errorf("child row of relation %s has no value for id column %s", r.Property, r.IdColumn)
+	}
+	e := egdm.NewEntity().SetID(strings.ReplaceAll(r.URIValuePattern, "{value}", fmt.Sprint(id)))
+	for k, v := range row {
+		e.Properties[r.BaseURI+k] = v
+	}
+	return e, nil
+}
+
+// incomingRelations returns the relations of the dataset with the defaults of the incoming mapping
+func incomingRelations(definition *cdl.DatasetDefinition, idColumn string) ([]*relation, error) {
+	rels, err := datasetRelations(definition)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range rels {
+		if rel.Key == "" {
+			rel.Key = idColumn
+		}
+		if rel.BaseURI == "" && definition.IncomingMappingConfig != nil {
+			rel.BaseURI = definition.IncomingMappingConfig.BaseURI
+		}
+	}
+	return rels, nil
+}
+
+// childRows converts the mapped property value of a parent row into rows of the child table.
+// Sub-entities are written with their properties as columns and the id, stripped of the uri
+// value pattern, as id column. Objects are written with their keys as columns.
+func (r *relation) childRows(value any, parentKey any) ([]*RowItem, error) {
+	var children []any
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []any:
+		children = v
+	case []*egdm.Entity:
+		for _, e := range v {
+			children = append(children, e)
+		}
+	default:
+		children = []any{v}
+	}
+
+	rows := make([]*RowItem, 0, len(children))
+	for _, child := range children {
+		row := &RowItem{Map: map[string]any{}}
+		switch c := child.(type) {
+		case *egdm.Entity:
+			if r.IdColumn != "" && c.ID != "" {
+				row.SetValue(columnKey(r.IdColumn), r.entityKey(c.ID))
+			}
+			for k, v := range c.Properties {
+				row.SetValue(r.column(k), v)
+			}
+			for k, v := range c.References {
+				row.SetValue(r.column(k), v)
+			}
+		case map[string]any:
+			for k, v := range c {
+				row.SetValue(columnKey(k), v)
+			}
+		default:
+			return nil, fmt.Errorf("relation %s expects sub-entities or objects, got %T", r.Property, child)
+		}
+		fk := columnKey(r.ForeignKey)
+		if _, found := row.Map[fk]; !found {
+			row.Columns = append(row.Columns, fk)
+		}
+		row.Map[fk] = parentKey
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// column returns the child table column of a sub-entity property
+func (r *relation) column(property string) string {
+	if r.BaseURI != "" && strings.HasPrefix(property, r.BaseURI) {
+		return strings.ToLower(strings.TrimPrefix(property, r.BaseURI))
+	}
+	return strings.ToLower(property[strings.LastIndexAny(property, "/#")+1:])
+}
+
+// entityKey returns the id column value of a sub-entity id
+func (r *relation) entityKey(id string) string {
+	prefix, suffix, found := strings.Cut(r.URIValuePattern, "{value}")
+	if !found {
+		return id
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(id, prefix), suffix)
+}
+
+// childStatements returns the statements that replace the child rows of the pending batch.
+// The child rows of all written and deleted parents are deleted before the parent rows are
+// written, and the child rows of live parents are inserted after them, so that foreign key
+// constraints hold. Soft deleted parents keep their child rows.
+func (o *PgsqlWriter) childStatements() ([]string, []string) {
+	var deletes, inserts []string
+	for _, rel := range o.relations {
+		var keys []string
+		var rows []*RowItem
+		for _, item := range o.batch {
+			if item.deleted && o.softDeleteColumn != "" {
+				continue
+			}
+			if key := item.Map[rel.Key]; key != nil {
+				keys = append(keys, sqlVal(key))
+			}
+			if !item.deleted {
+				rows = append(rows, item.children[rel.Property]...)
+			}
+		}
+		if len(keys) > 0 {
+			deletes = append(deletes, "DELETE FROM "+tableRef(o.schema, rel.Table)+" WHERE "+quoteIdentifier(rel.ForeignKey)+" IN ("+strings.Join(keys, ", ")+")")
+		}
+		if len(rows) > 0 {
+			table := tableRef(o.schema, rel.Table)
+			inserts = append(inserts, insertRowsStatement(table, rows, o.arrayColumns[table]))
+		}
+	}
+	return deletes, inserts
+}
+
+// insertRowsStatement renders a plain multi-row insert of the rows into the table, lists are
+// written as arrays to the array columns
+func insertRowsStatement(table string, rows []*RowItem, arrays map[string]bool) string {
+	columns := batchColumns(rows)
+	quoted := make([]string, len(columns))
+	for i, col := range columns {
+		quoted[i] = quoteIdentifier(col)
+	}
+
+	var b strings.Builder
+	b.WriteString("INSERT INTO " + table + " (" + strings.Join(quoted, ", ") + ") VALUES")
+	for r, row := range rows {
+		if r > 0 {
+			b.WriteString(",")
+		}
+		vals := make([]string, len(columns))
+		for i, col := range columns {
+			vals[i] = columnVal(row.Map[col], arrays[identifierName(col)])
+		}
+		b.WriteString(" (" + strings.Join(vals, ", ") + ")")
+	}
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package layer
+
+import (
+	"reflect"
+	"testing"
+
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func TestRelationValue(t *testing.T) {
+	rows := []byte(`[{"id": 1, "product_id": 7, "name": "wheel"}, {"id": 2, "product_id": 7, "name": "axle"}]`)
+
+	list := &relation{Property: "parts"}
+	v, err := list.value(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []any{
+		map[string]any{"id": int64(1), "product_id": int64(7), "name": "wheel"},
+		map[string]any{"id": int64(2), "product_id": int64(7), "name": "axle"},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("unexpected list %#v", v)
+	}
+
+	if v, _ = list.value(nil); !reflect.DeepEqual(v, []any{}) {
+		t.Errorf("expected empty list without child rows, got %#v", v)
+	}
+
+	entities := &relation{Property: "parts", IdColumn: "id", URIValuePattern: "http://data.test.io/part/{value}", BaseURI: "http://data.test.io/"}
+	v, err = entities.value(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs, ok := v.([]*egdm.Entity)
+	if !ok || len(subs) != 2 {
+		t.Fatalf("expected two sub-entities, got %#v", v)
+	}
+	if subs[1].ID != "http://data.test.io/part/2" || subs[1].Properties["http://data.test.io/name"] != "axle" {
+		t.Errorf("unexpected sub-entity %+v", subs[1])
+	}
+
+	single := &relation{Property: "maker", Single: true}
+	v, err = single.value([]byte(`{"id": "m1", "score": 1.5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, map[string]any{"id": "m1", "score": 1.5}) {
+		t.Errorf("unexpected single value %#v", v)
+	}
+	if v, _ = single.value([]byte("null")); v != nil {
+		t.Errorf("expected nil without child row, got %#v", v)
+	}
+}
+
+func TestBuildQuerySkipsMappedRelationProperty(t *testing.T) {
+	def := testDefinition(map[string]any{TableName: "product", Relations: []any{
+		map[string]any{"property": "name", "table": "product_name", "foreign_key": "product_id"},
+	}})
+	q, _, err := buildQuery(def, "", "", "", "", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `SELECT "id", (SELECT json_agg(c) FROM "product_name" c WHERE c."product_id" = "product"."id") AS "name" FROM "product"`
+	if q != expected {
+		t.Errorf("unexpected query\n got: %s\nwant: %s", q, expected)
+	}
+}
@@ -0,0 +1,121 @@
+package layer
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// replicaSettings are the read replicas of the system config. Each replica is a host name or
+// an object of connection settings overriding those of the primary. A single replica may be
+// given without a list.
+type replicaSettings []map[string]any
+
+func (r *replicaSettings) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || bytes.Equal(b, []byte("null")) {
+		*r = nil
+		return nil
+	}
+	if b[0] != '[' {
+		b = append(append([]byte("["), b...), ']')
+	}
+	var items []any
+	if err := json.Unmarshal(b, &items); err != nil {
+		return err
+	}
+	replicas := make(replicaSettings, 0, len(items))
+	for _, item := range items {
+		switch v := item.(type) {
+		case string:
+			replicas = append(replicas, map[string]any{"host": v})
+		case map[string]any:
+			replicas = append(replicas, v)
+		default:
+			return fmt.Errorf("read replica must be a host name or an object of connection settings")
+		}
+	}
+	*r = replicas
+	return nil
+}
+
+// replicaConfig returns the native config of a read replica of the primary
+func replicaConfig(primary map[string]any, overrides map[string]any) map[string]any {
+	native := overlayConnection(primary, overrides)
+	delete(native, ReadReplicas)
+	delete(native, MaxReplicaLag)
+	return native
+}
+
+// replica returns the next read replica of the pool, or nil when it has none. Reads are
+// spread over the replicas in turn.
+func (p *pgsqlDB) replica() *pgsqlDB {
+	if len(p.replicas) == 0 {
+		return nil
+	}
+	n := p.nextReplica.Add(1)
+	return p.replicas[int(n-1)%len(p.replicas)]
+}
+
+// replicaLagQuery returns how far the server is behind the primary. A replica that has
+// replayed all it received is not behind, however long ago the last change was.
+const replicaLagQuery = `SELECT CASE WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END::float8`
+
+func replicaLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	var seconds float64
+	if err := db.QueryRowContext(ctx, replicaLagQuery).Scan(&seconds); err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// readPool returns the pool the dataset is read from: a read replica when there are any, else
+// the primary. With a maximum replica lag, a replica lagging more than that is passed over
+// for the primary. Writes and change data capture always use the primary.
+func (d *Dataset) readPool(ctx context.Context) *pgsqlDB {
+	primary := d.db
+	replica := primary.replica()
+	if replica == nil {
+		return primary
+	}
+	if primary.maxReplicaLag > 0 {
+		lag, err := replicaLag(ctx, replica.db)
+		if err != nil {
+			d.logger.Warn("could not check the lag of the read replica, reading from the primary", "dataset", d.Name(), "error", err)
+			return primary
+		}
+		if lag > primary.maxReplicaLag {
+			d.logger.Debug("read replica lags behind, reading from the primary", "dataset", d.Name(), "lag", lag.String())
+			return primary
+		}
+	}
+	return replica
+}
+
+// sinceBehind tells if the latest since value of a server is before the since value of a
+// token, the server then has not seen all changes the token was handed out for
+func sinceBehind(latest string, since string, datatype string) bool {
+	if since == "" {
+		return false
+	}
+	if latest == "" {
+		return true
+	}
+	switch datatype {
+	case "int":
+		l, err1 := strconv.ParseInt(latest, 10, 64)
+		s, err2 := strconv.ParseInt(since, 10, 64)
+		return err1 == nil && err2 == nil && l < s
+	case "float":
+		l, err1 := strconv.ParseFloat(latest, 64)
+		s, err2 := strconv.ParseFloat(since, 64)
+		return err1 == nil && err2 == nil && l < s
+	}
+	// time values are formatted with sinceTimeFormat, which orders as text
+	return latest < since
+}
@@ -0,0 +1,99 @@
+package layer
+
+import (
+	"context"
+	"testing"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+func TestReplicaSettings(t *testing.T) {
+	for _, tt := range []struct {
+		replicas any
+		hosts    []string
+	}{
+		{"replica1", []string{"replica1"}},
+		{map[string]any{"host": "replica1", "port": "5433"}, []string{"replica1"}},
+		{[]any{"replica1", map[string]any{"host": "replica2"}}, []string{"replica1", "replica2"}},
+		{nil, nil},
+	} {
+		c, err := pgsqlConfOf(map[string]any{"host": "primary", ReadReplicas: tt.replicas})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.ReadReplicas) != len(tt.hosts) {
+			t.Fatalf("expected replicas %v, got %v", tt.hosts, c.ReadReplicas)
+		}
+		for i, host := range tt.hosts {
+			if c.ReadReplicas[i]["host"] != host {
+				t.Errorf("expected replica %s, got %v", host, c.ReadReplicas[i])
+			}
+		}
+	}
+
+	if _, err := pgsqlConfOf(map[string]any{ReadReplicas: []any{5432}}); err == nil {
+		t.Error("expected an error for a replica that is not a host or object")
+	}
+}
+
+func TestReplicaConfig(t *testing.T) {
+	primary := map[string]any{
+		"host": "primary", "user": "layer", "password": "secret", "connection_string": "host=primary",
+		ReadReplicas: []any{"replica1"}, MaxReplicaLag: "5s",
+	}
+	native := replicaConfig(primary, map[string]any{"host": "replica1"})
+	if native["host"] != "replica1" || native["user"] != "layer" || native["password"] != "secret" {
+		t.Errorf("expected the replica to connect like the primary, got %v", native)
+	}
+	for _, key := range []string{"connection_string", ReadReplicas, MaxReplicaLag} {
+		if _, ok := native[key]; ok {
+			t.Errorf("expected %s to be left out of the replica config, got %v", key, native)
+		}
+	}
+
+	// datasets connecting elsewhere do not read from the replicas of the system config
+	native, _ = datasetConnectionConfig(primary, map[string]any{Connection: map[string]any{"host": "archive"}})
+	if _, ok := native[ReadReplicas]; ok {
+		t.Errorf("expected the replicas of the system config to be left out, got %v", native)
+	}
+}
+
+func TestReplicaRotation(t *testing.T) {
+	primary := &pgsqlDB{}
+	if primary.replica() != nil {
+		t.Fatal("expected no replica")
+	}
+	d := &Dataset{db: primary, datasetDefinition: &cdl.DatasetDefinition{}}
+	if d.readPool(context.Background()) != primary {
+		t.Error("expected reads from the primary without replicas")
+	}
+
+	r1, r2 := &pgsqlDB{}, &pgsqlDB{}
+	primary.replicas = []*pgsqlDB{r1, r2}
+	expected := []*pgsqlDB{r1, r2, r1, r2}
+	for i, r := range expected {
+		if got := d.readPool(context.Background()); got != r {
+			t.Errorf("expected replica %d in turn %d", i%2+1, i)
+		}
+	}
+}
+
+func TestSinceBehind(t *testing.T) {
+	for _, tt := range []struct {
+		latest, since, datatype string
+		behind                  bool
+	}{
+		{"2024-01-02 00:00:00.000000", "2024-01-01 12:00:00.000000", "time", false},
+		{"2024-01-01 00:00:00.000000", "2024-01-01 12:00:00.000000", "time", true},
+		{"", "2024-01-01 12:00:00.000000", "time", true},
+		{"2024-01-01 00:00:00.000000", "", "time", false},
+		{"9", "10", "int", true},
+		{"10", "10", "int", false},
+		{"2.5", "10", "float", true},
+		{"b", "a", "string", false},
+	} {
+		if behind := sinceBehind(tt.latest, tt.since, tt.datatype); behind != tt.behind {
+			t.Errorf("expected %v for %s since %s, got %v", tt.behind, tt.latest, tt.since, behind)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package layer
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+// tableColumn is a column of a table created from the incoming mapping. The type is empty
+// when it is inferred from the written values.
+type tableColumn struct {
+	name       string
+	dataType   string
+	primaryKey bool
+}
+
+// mappingColumns returns the columns of the table written by the dataset: the mapped
+// properties, with the identity as primary key, and the since, deleted and entity columns.
+// Relation properties are written to their child tables and are left out.
+func mappingColumns(definition *common.DatasetDefinition) ([]*tableColumn, error) {
+	rels, err := datasetRelations(definition)
+	if err != nil {
+		return nil, err
+	}
+	relationColumns := map[string]bool{}
+	for _, rel := range rels {
+		relationColumns[rel.Property] = true
+	}
+
+	var columns []*tableColumn
+	seen := map[string]bool{}
+	add := func(c *tableColumn) {
+		key := columnKey(c.name)
+		if key == "" || seen[key] || relationColumns[key] {
+			return
+		}
+		seen[key] = true
+		columns = append(columns, c)
+	}
+
+	if definition.IncomingMappingConfig != nil {
+		for _, pm := range definition.IncomingMappingConfig.PropertyMappings {
+			c := &tableColumn{name: pm.Property, dataType: declaredType(pm.Datatype), primaryKey: pm.IsIdentity}
+			switch {
+			case c.dataType != "":
+			case pm.IsIdentity || pm.IsReference:
+				c.dataType = "TEXT"
+			case pm.IsDeleted:
+				c.dataType = "BOOLEAN"
+			case pm.IsRecorded:
+				c.dataType = "BIGINT"
+			}
+			add(c)
+		}
+	}
+
+	entityColumn := getStringConfigProperty(definition.SourceConfig, EntityColumn)
+	if entityColumn != "" {
+		if !hasPrimaryKey(columns) {
+			add(&tableColumn{name: "id", dataType: "TEXT", primaryKey: true})
+		}
+		add(&tableColumn{name: entityColumn, dataType: "JSONB"})
+	}
+	if sinceColumn := getStringConfigProperty(definition.SourceConfig, SinceColumn); sinceColumn != "" {
+		add(&tableColumn{name: sinceColumn, dataType: "TIMESTAMPTZ"})
+	}
+	if deletedColumn := getStringConfigProperty(definition.SourceConfig, DeletedColumn); deletedColumn != "" {
+		dataType := "BOOLEAN"
+		if v, ok := definition.SourceConfig[DeletedValue]; ok && v != nil {
+			dataType = inferredType(v)
+		}
+		add(&tableColumn{name: deletedColumn, dataType: dataType})
+	}
+	return columns, nil
+}
+
+func hasPrimaryKey(columns []*tableColumn) bool {
+	for _, c := range columns {
+		if c.primaryKey {
+			return true
+		}
+	}
+	return false
+}
+
+// declaredType returns the column type of a mapping datatype. The datatypes of the outgoing
+// mapping are translated, any other datatype is taken as a column type.
+func declaredType(datatype string) string {
+	switch strings.ToLower(datatype) {
+	case "":
+		return ""
+	case "int", "integer":
+		return "INTEGER"
+	case "long":
+		return "BIGINT"
+	case "float":
+		return "REAL"
+	case "double":
+		return "DOUBLE PRECISION"
+	case "bool", "boolean":
+		return "BOOLEAN"
+	case "string":
+		return "TEXT"
+	case "json":
+		return "JSONB"
+	case "time", "datetime":
+		return "TIMESTAMPTZ"
+	}
+	return datatype
+}
+
+// inferredType returns the column type of a written value, TEXT when there is none
+func inferredType(v any) string {
+	switch val := v.(type) {
+	case bool:
+		return "BOOLEAN"
+	case int, int32, int64:
+		return "BIGINT"
+	case float64:
+		return "DOUBLE PRECISION"
+	case json.Number:
+		return "NUMERIC"
+	case time.Time:
+		return "TIMESTAMPTZ"
+	case map[string]any, *egdm.Entity, json.RawMessage:
+		return "JSONB"
+	case []any:
+		for _, e := range val {
+			if e == nil {
+				continue
+			}
+			switch e.(type) {
+			case bool, int, int32, int64, float64, json.Number, string:
+				return inferredType(e) + "[]"
+			}
+			return "TEXT[]"
+		}
+		return "TEXT[]"
+	case []string:
+		return "TEXT[]"
+	}
+	return "TEXT"
+}
+
+// createTableStatement returns the statement creating the table when it does not exist. Columns
+// without a declared type get the type of their first value in the rows.
+func createTableStatement(table string, columns []*tableColumn, rows []*RowItem) string {
+	defs := make([]string, 0, len(columns))
+	var keys []string
+	for _, c := range columns {
+		defs = append(defs, quoteIdentifier(c.name)+" "+c.resolvedType(rows))
+		if c.primaryKey {
+			keys = append(keys, quoteIdentifier(c.name))
+		}
+	}
+	if len(keys) > 0 {
+		defs = append(defs, "PRIMARY KEY ("+strings.Join(keys, ", ")+")")
+	}
+	return "CREATE TABLE IF NOT EXISTS " + table + " (" + strings.Join(defs, ", ") + ")"
+}
+
+// addColumnStatements returns the statements adding the columns to the table when missing.
+// Columns without a declared type get the type of their first value in the rows.
+func addColumnStatements(table string, columns []*tableColumn, rows []*RowItem) []string {
+	stmts := make([]string, 0, len(columns))
+	for _, c := range columns {
+		stmts = append(stmts, "ALTER TABLE "+table+" ADD COLUMN IF NOT EXISTS "+quoteIdentifier(c.name)+" "+c.resolvedType(rows))
+	}
+	return stmts
+}
+
+func (c *tableColumn) resolvedType(rows []*RowItem) string {
+	if c.dataType != "" {
+		return c.dataType
+	}
+	for _, row := range rows {
+		for _, col := range row.Columns {
+			if v := row.Map[col]; v != nil && columnKey(col) == columnKey(c.name) {
+				return inferredType(v)
+			}
+		}
+	}
+	return "TEXT"
+}
+
+// ensureTable creates the table of the writer from the incoming mapping before its first batch
+// is written, see AutoCreate. The columns of properties mapped since the table was created are
+// added to it, columns are never dropped or changed.
+func (o *PgsqlWriter) ensureTable(table string, rows []*RowItem) error {
+	if o.tableColumns == nil || o.tableEnsured {
+		return nil
+	}
+	err := o.exec(createTableStatement(table, o.tableColumns, rows))
+	if err != nil {
+		return err
+	}
+	existing, err := o.catalogColumns(columnsQuery, table)
+	if err != nil {
+		return o.rollback(err)
+	}
+	var added []*tableColumn
+	for _, c := range o.tableColumns {
+		if !existing[identifierName(c.name)] {
+			added = append(added, c)
+		}
+	}
+	if len(added) > 0 {
+		if err = o.exec(addColumnStatements(table, added, rows)...); err != nil {
+			return err
+		}
+	}
+	o.tableEnsured = true
+	return nil
+}
+
+// columnsQuery returns the columns of a table
+const columnsQuery = `SELECT attname FROM pg_attribute WHERE attrelid = to_regclass($1) AND attnum > 0 AND NOT attisdropped`
+
+// catalogColumns returns the catalog names of the columns of the table returned by the query
+func (o *PgsqlWriter) catalogColumns(query string, table string) (map[string]bool, error) {
+	rows, err := o.tx.QueryContext(o.ctx, query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
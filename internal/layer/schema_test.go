@@ -0,0 +1,93 @@
+package layer
+
+import (
+	"encoding/json"
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+func TestCreateTableStatement(t *testing.T) {
+	definition := &common.DatasetDefinition{
+		DatasetName: "products",
+		SourceConfig: map[string]any{
+			TableName:     "product",
+			SinceColumn:   "updated",
+			DeletedColumn: "deleted",
+			AutoCreate:    true,
+			Relations: []any{
+				map[string]any{"property": "parts", "table": "part", "foreign_key": "product_id"},
+			},
+		},
+		IncomingMappingConfig: &common.IncomingMappingConfig{
+			PropertyMappings: []*common.EntityToItemPropertyMapping{
+				{Property: "id", IsIdentity: true},
+				{Property: "name", EntityProperty: "name"},
+				{Property: "price", EntityProperty: "price", Datatype: "NUMERIC(10,2)"},
+				{Property: "stock", EntityProperty: "stock", Datatype: "long"},
+				{Property: "tags", EntityProperty: "tags"},
+				{Property: "color", EntityProperty: "color"},
+				{Property: "maker", EntityProperty: "maker", IsReference: true},
+				{Property: "parts", EntityProperty: "parts"},
+			},
+		},
+	}
+	columns, err := mappingColumns(definition)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []*RowItem{
+		{Map: map[string]any{"name": nil, "tags": []any{nil, "a"}}, Columns: []string{"name", "tags"}},
+		{Map: map[string]any{"Name": json.Number("1.5")}, Columns: []string{"Name"}},
+		{Map: map[string]any{"name": true}, Columns: []string{"name"}},
+	}
+
+	expected := `CREATE TABLE IF NOT EXISTS product ("id" TEXT, "name" NUMERIC, "price" NUMERIC(10,2), "stock" BIGINT, ` +
+		`"tags" TEXT[], "color" TEXT, "maker" TEXT, "updated" TIMESTAMPTZ, "deleted" BOOLEAN, PRIMARY KEY ("id"))`
+	if stmt := createTableStatement("product", columns, rows); stmt != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, stmt)
+	}
+
+	expectedAlter := []string{
+		`ALTER TABLE product ADD COLUMN IF NOT EXISTS "name" TEXT`,
+		`ALTER TABLE product ADD COLUMN IF NOT EXISTS "price" NUMERIC(10,2)`,
+	}
+	assertStatements(t, addColumnStatements("product", columns[1:3], nil), expectedAlter)
+}
+
+func TestEntityColumnTable(t *testing.T) {
+	definition := &common.DatasetDefinition{
+		DatasetName:  "customers",
+		SourceConfig: map[string]any{TableName: "customer", EntityColumn: "entity", SinceColumn: "modified"},
+	}
+	columns, err := mappingColumns(definition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `CREATE TABLE IF NOT EXISTS customer ("id" TEXT, "entity" JSONB, "modified" TIMESTAMPTZ, PRIMARY KEY ("id"))`
+	if stmt := createTableStatement("customer", columns, nil); stmt != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, stmt)
+	}
+}
+
+func TestInferredType(t *testing.T) {
+	cases := map[string]any{
+		"BOOLEAN":            true,
+		"BIGINT":             int64(3),
+		"DOUBLE PRECISION":   1.5,
+		"NUMERIC":            json.Number("1.50"),
+		"JSONB":              map[string]any{"a": 1},
+		"DOUBLE PRECISION[]": []any{nil, 1.0},
+		"TEXT[]":             []string{"a"},
+		"TEXT":               "a",
+	}
+	for expected, v := range cases {
+		if got := inferredType(v); got != expected {
+			t.Errorf("expected %s for %v, got %s", expected, v, got)
+		}
+	}
+	if got := inferredType([]any{map[string]any{}}); got != "TEXT[]" {
+		t.Errorf("expected TEXT[] for a list of objects, got %s", got)
+	}
+}
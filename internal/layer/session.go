@@ -0,0 +1,165 @@
+package layer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// sessionSetting is a server setting applied to the transactions of a dataset
+type sessionSetting struct {
+	name  string
+	value string
+}
+
+// serverTimeouts are the timeout settings passed on to the server, in the system config as
+// well as in the source config
+var serverTimeouts = []string{StatementTimeout, IdleInTransactionTimeout}
+
+// parseTimeout parses a duration setting such as "30s" or "5m"
+func parseTimeout(name string, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must not be negative", name, value)
+	}
+	return d, nil
+}
+
+// serverDuration formats a duration as milliseconds, the unit of the server timeouts
+func serverDuration(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
+
+// applyConnectionSettings sets the server timeouts of the system config as runtime params of
+// every connection
+func applyConnectionSettings(config *pgx.ConnConfig, c *PgsqlConf) error {
+	for name, value := range map[string]string{
+		StatementTimeout:         c.StatementTimeout,
+		IdleInTransactionTimeout: c.IdleInTransactionTimeout,
+	} {
+		if value == "" {
+			continue
+		}
+		d, err := parseTimeout(name, value)
+		if err != nil {
+			return err
+		}
+		config.RuntimeParams[name] = serverDuration(d)
+	}
+	return nil
+}
+
+// poolLimit is a connection count of the pool settings. It may be written as a number or as a
+// string, as in dataset connections filled from the environment.
+type poolLimit int
+
+func (l *poolLimit) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	var n float64
+	switch v := v.(type) {
+	case nil:
+		*l = 0
+		return nil
+	case float64:
+		n = v
+	case string:
+		var err error
+		if n, err = strconv.ParseFloat(v, 64); err != nil {
+			return fmt.Errorf("%q is not a whole number", v)
+		}
+	default:
+		return fmt.Errorf("%s is not a whole number", b)
+	}
+	if n < 0 || n != float64(int(n)) {
+		return fmt.Errorf("%s is not a whole number", b)
+	}
+	*l = poolLimit(n)
+	return nil
+}
+
+// applyPoolSettings sets the connection pool limits of the system config. Unset limits keep
+// the defaults of database/sql.
+func applyPoolSettings(db *sql.DB, c *PgsqlConf) error {
+	if c.MaxOpenConnections > 0 {
+		db.SetMaxOpenConns(int(c.MaxOpenConnections))
+	}
+	if c.MaxIdleConnections > 0 {
+		db.SetMaxIdleConns(int(c.MaxIdleConnections))
+	}
+	if c.ConnectionMaxLifetime != "" {
+		d, err := parseTimeout(ConnectionMaxLifetime, c.ConnectionMaxLifetime)
+		if err != nil {
+			return err
+		}
+		db.SetConnMaxLifetime(d)
+	}
+	if c.ConnectionMaxIdleTime != "" {
+		d, err := parseTimeout(ConnectionMaxIdleTime, c.ConnectionMaxIdleTime)
+		if err != nil {
+			return err
+		}
+		db.SetConnMaxIdleTime(d)
+	}
+	return nil
+}
+
+// sessionSettings returns the server timeouts of the source config, which override those of
+// the system config for the transactions of the dataset
+func sessionSettings(sourceConfig map[string]any) ([]sessionSetting, error) {
+	var settings []sessionSetting
+	for _, name := range serverTimeouts {
+		value := getStringConfigProperty(sourceConfig, name)
+		if value == "" {
+			continue
+		}
+		d, err := parseTimeout(name, value)
+		if err != nil {
+			return nil, err
+		}
+		settings = append(settings, sessionSetting{name: name, value: serverDuration(d)})
+	}
+	return settings, nil
+}
+
+// applySessionSettings sets the settings for the rest of the transaction
+func applySessionSettings(ctx context.Context, tx *sql.Tx, settings []sessionSetting) error {
+	for _, s := range settings {
+		if _, err := tx.ExecContext(ctx, "SELECT set_config($1, $2, true)", s.name, s.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readContext returns the context of a read of the dataset. It has a deadline when a read
+// timeout is set in the source or system config, the read is then cancelled when the rows are
+// not consumed in time.
+func (d *Dataset) readContext() (context.Context, context.CancelFunc, error) {
+	var timeout time.Duration
+	if value := getStringConfigProperty(d.datasetDefinition.SourceConfig, ReadTimeout); value != "" {
+		t, err := parseTimeout(ReadTimeout, value)
+		if err != nil {
+			return nil, nil, err
+		}
+		timeout = t
+	} else if d.db != nil {
+		timeout = d.db.readTimeout
+	}
+	if timeout == 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	return ctx, cancel, nil
+}
@@ -0,0 +1,115 @@
+package layer
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+func TestSessionSettings(t *testing.T) {
+	settings, err := sessionSettings(map[string]any{
+		TableName:                "product",
+		StatementTimeout:         "30s",
+		IdleInTransactionTimeout: "1m30s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []sessionSetting{{StatementTimeout, "30000"}, {IdleInTransactionTimeout, "90000"}}
+	if len(settings) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, settings)
+	}
+	for i, s := range settings {
+		if s != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], s)
+		}
+	}
+
+	if _, err := sessionSettings(map[string]any{StatementTimeout: "30"}); err == nil {
+		t.Error("expected an error for a duration without unit")
+	}
+	if _, err := sessionSettings(map[string]any{StatementTimeout: "-1s"}); err == nil {
+		t.Error("expected an error for a negative duration")
+	}
+	if settings, _ := sessionSettings(map[string]any{}); len(settings) != 0 {
+		t.Errorf("expected no settings, got %v", settings)
+	}
+}
+
+func TestConnectionSettings(t *testing.T) {
+	c := &PgsqlConf{
+		Hostname:                 "localhost",
+		Port:                     "5432",
+		Database:                 "test",
+		User:                     "postgres",
+		MaxOpenConnections:       8,
+		MaxIdleConnections:       4,
+		ConnectionMaxLifetime:    "30m",
+		StatementTimeout:         "2m",
+		IdleInTransactionTimeout: "10s",
+	}
+	config, err := pgx.ParseConfig(c.dsn())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConnectionSettings(config, c); err != nil {
+		t.Fatal(err)
+	}
+	if v := config.RuntimeParams[StatementTimeout]; v != "120000" {
+		t.Errorf("expected statement timeout 120000, got %s", v)
+	}
+	if v := config.RuntimeParams[IdleInTransactionTimeout]; v != "10000" {
+		t.Errorf("expected idle in transaction timeout 10000, got %s", v)
+	}
+
+	// no connection is made until the pool is used
+	db := sql.OpenDB(stdlib.GetConnector(*config))
+	defer db.Close()
+	if err := applyPoolSettings(db, c); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.Stats().MaxOpenConnections; n != 8 {
+		t.Errorf("expected 8 max open connections, got %d", n)
+	}
+
+	c.ConnectionMaxIdleTime = "soon"
+	if err := applyPoolSettings(db, c); err == nil {
+		t.Error("expected an error for an invalid duration")
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	d := &Dataset{
+		db:                &pgsqlDB{readTimeout: time.Minute},
+		datasetDefinition: &cdl.DatasetDefinition{SourceConfig: map[string]any{}},
+	}
+	ctx, cancel, err := d.readContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline, ok := ctx.Deadline()
+	cancel()
+	if !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("expected the read timeout of the system config, got %v", deadline)
+	}
+
+	d.datasetDefinition.SourceConfig[ReadTimeout] = "5s"
+	ctx, cancel, _ = d.readContext()
+	deadline, _ = ctx.Deadline()
+	cancel()
+	if time.Until(deadline) > 5*time.Second {
+		t.Errorf("expected the read timeout of the dataset, got %v", deadline)
+	}
+
+	d.db.readTimeout = 0
+	delete(d.datasetDefinition.SourceConfig, ReadTimeout)
+	ctx, cancel, _ = d.readContext()
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expected no deadline without read timeout")
+	}
+}
@@ -0,0 +1,63 @@
+package layer
+
+import (
+	"strings"
+)
+
+// the columns of a tombstone table, see TombstoneDDL
+const (
+	tombstoneIdColumn   = "id"
+	tombstoneTimeColumn = "deleted_at"
+)
+
+// tombstoneMarkerColumn is selected as true for the rows read from the tombstone table
+const tombstoneMarkerColumn = "_tombstone"
+
+// tombstoneQuery unions the rows of the table with the rows of its tombstone table. Tombstones
+// are expanded to rows of the table where only the identity and since columns are set, and
+// are left out while a row with the same identity exists, as the table is often written by
+// deleting and inserting rows again. The result is aliased as the table, so that conditions
+// on the table columns can be added to it. The table names are quoted, the column names not.
+func tombstoneQuery(cols string, table string, alias string, tombstoneTable string, idColumn string, sinceColumn string) string {
+	tombstones := "SELECT (jsonb_populate_record(NULL::" + table + ", jsonb_build_object(" +
+		sqlVal(identifierName(idColumn)) + ", t." + quoteIdentifier(tombstoneIdColumn) + ", " +
+		sqlVal(identifierName(sinceColumn)) + ", t." + quoteIdentifier(tombstoneTimeColumn) + "))).* FROM " + tombstoneTable + " t" +
+		" WHERE NOT EXISTS (SELECT 1 FROM " + table + " l WHERE l." + quoteIdentifier(idColumn) + " = t." + quoteIdentifier(tombstoneIdColumn) + ")"
+
+	return "SELECT * FROM (SELECT " + cols + ", FALSE AS " + tombstoneMarkerColumn + " FROM " + table +
+		" UNION ALL SELECT " + cols + ", TRUE FROM (" + tombstones + ") AS " + alias + ") AS " + alias
+}
+
+// TombstoneDDL returns the statements that create a tombstone table for the table and the
+// trigger that records the identity and time of every deleted row in it. Inserting a row removes
+// the tombstone of its identity, so that writes deleting and inserting rows again leave no
+// tombstones behind. The table is created from the identity and since columns of the table, so
+// that it has the same column types.
+func TombstoneDDL(tableName string, tombstoneTable string, idColumn string, sinceColumn string) string {
+	if tombstoneTable == "" {
+		tombstoneTable = suffixName(tableName, "_tombstone")
+	}
+	table := quoteName(tableName)
+	tomb := quoteName(tombstoneTable)
+	name := identifierName(unqualifiedName(tombstoneTable))
+	idCol := quoteIdentifier(tombstoneIdColumn)
+	timeCol := quoteIdentifier(tombstoneTimeColumn)
+
+	var b strings.Builder
+	b.WriteString("CREATE TABLE IF NOT EXISTS " + tomb + " AS SELECT " + quoteIdentifier(idColumn) + " AS " + idCol +
+		", " + quoteIdentifier(sinceColumn) + " AS " + timeCol + " FROM " + table + " WITH NO DATA;\n")
+	b.WriteString("CREATE INDEX IF NOT EXISTS " + quoteExact(name+"_"+tombstoneTimeColumn) + " ON " + tomb + " (" + timeCol + ");\n\n")
+	b.WriteString("CREATE OR REPLACE FUNCTION " + tomb + "() RETURNS trigger AS $$\n")
+	b.WriteString("BEGIN\n")
+	b.WriteString("    IF TG_OP = 'INSERT' THEN\n")
+	b.WriteString("        DELETE FROM " + tomb + " WHERE " + idCol + " = NEW." + quoteIdentifier(idColumn) + ";\n")
+	b.WriteString("        RETURN NEW;\n")
+	b.WriteString("    END IF;\n")
+	b.WriteString("    INSERT INTO " + tomb + " (" + idCol + ", " + timeCol + ") VALUES (OLD." + quoteIdentifier(idColumn) + ", NOW());\n")
+	b.WriteString("    RETURN OLD;\n")
+	b.WriteString("END;\n")
+	b.WriteString("$$ LANGUAGE plpgsql;\n\n")
+	b.WriteString("DROP TRIGGER IF EXISTS " + quoteExact(name) + " ON " + table + ";\n")
+	b.WriteString("CREATE TRIGGER " + quoteExact(name) + " AFTER INSERT OR DELETE ON " + table + " FOR EACH ROW EXECUTE FUNCTION " + tomb + "();\n")
+	return b.String()
+}
@@ -0,0 +1,343 @@
+package layer
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Column values are emitted with the following entity representations:
+//
+//	bool, integer and float types   JSON booleans and numbers
+//	numeric and decimal             JSON numbers with the exact digits of the value
+//	timestamp and timestamptz       time values, serialised as RFC 3339
+//	date                            the date as 2006-01-02
+//	json and jsonb                  the JSON value itself
+//	arrays                          lists of the element values, nested for more dimensions,
+//	                                or lists of references for reference mappings
+//	bytea                           the hex text form, \x0102
+//	all other types                 the PostgreSQL text form, e.g. uuid, interval, inet,
+//	                                enums, hstore and ranges
+//
+// The text forms are accepted by PostgreSQL as input, so these values can be written back.
+// Lists are written as array literals to array columns, see arrayLiteral, and as JSON otherwise.
+
+// scanBuffer returns the value a column of the given type is scanned into
+func scanBuffer(ct *sql.ColumnType) (any, error) {
+	dbType := ct.DatabaseTypeName()
+	switch dbType {
+	case "JSON", "JSONB":
+		return &json.RawMessage{}, nil
+	case "NUMERIC":
+		return &numericValue{}, nil
+	case "DATE":
+		return &dateValue{}, nil
+	case "BYTEA":
+		return &byteaValue{}, nil
+	}
+	if strings.HasPrefix(dbType, "_") {
+		return &arrayValue{elemType: dbType[1:]}, nil
+	}
+
+	st := ct.ScanType()
+	if st == nil {
+		return nil, fmt.Errorf("no scan type for column %s", ct.Name())
+	}
+	ex := reflect.New(st).Interface()
+	switch ex.(type) {
+	case *bool:
+		return &sql.NullBool{}, nil
+	case *int, *int16, *int32, *int64:
+		return &sql.NullInt64{}, nil
+	case *float32, *float64:
+		return &sql.NullFloat64{}, nil
+	case *time.Time:
+		return &sql.NullTime{}, nil
+	case *sql.NullInt32:
+		return &sql.NullInt32{}, nil
+	case *sql.NullTime:
+		return &sql.NullTime{}, nil
+	default:
+		return &sql.NullString{}, nil
+	}
+}
+
+// numericValue keeps numeric values as their exact text so they are emitted without float loss
+type numericValue struct {
+	sql.NullString
+}
+
+func (v *numericValue) value() any {
+	if !v.Valid {
+		return nil
+	}
+	return json.Number(v.String)
+}
+
+// dateValue emits dates without a time of day
+type dateValue struct {
+	sql.NullTime
+}
+
+func (v *dateValue) value() any {
+	if !v.Valid {
+		return nil
+	}
+	return v.Time.Format(time.DateOnly)
+}
+
+// byteaValue emits binary data in the hex text form
+type byteaValue struct {
+	data  []byte
+	valid bool
+}
+
+func (v *byteaValue) Scan(src any) error {
+	switch s := src.(type) {
+	case nil:
+		v.data, v.valid = nil, false
+	case []byte:
+		v.data, v.valid = append(v.data[:0], s...), true
+	case string:
+		v.data, v.valid = []byte(s), true
+	default:
+		return fmt.Errorf("cannot scan %T into bytea", src)
+	}
+	return nil
+}
+
+func (v *byteaValue) value() any {
+	if !v.valid {
+		return nil
+	}
+	return "\\x" + hex.EncodeToString(v.data)
+}
+
+// arrayValue parses the text form of an array into a list of element values
+type arrayValue struct {
+	elemType string
+	list     []any
+	valid    bool
+}
+
+func (v *arrayValue) Scan(src any) error {
+	var text string
+	switch s := src.(type) {
+	case nil:
+		v.list, v.valid = nil, false
+		return nil
+	case []byte:
+		text = string(s)
+	case string:
+		text = s
+	default:
+		return fmt.Errorf("cannot scan %T into array", src)
+	}
+	list, err := parseArray(text, v.elemType)
+	if err != nil {
+		return err
+	}
+	v.list, v.valid = list, true
+	return nil
+}
+
+func (v *arrayValue) value() any {
+	if !v.valid {
+		return nil
+	}
+	return v.list
+}
+
+// parseArray parses an array in the PostgreSQL text form, such as {1,2,NULL} or {{"a b",c}}
+func parseArray(text string, elemType string) ([]any, error) {
+	// arrays with other lower bounds than 1 are prefixed with their dimensions, [0:1]={1,2}
+	if strings.HasPrefix(text, "[") {
+		i := strings.Index(text, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid array %q", text)
+		}
+		text = text[i+1:]
+	}
+	p := &arrayParser{text: text, elemType: elemType}
+	list, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.text) {
+		return nil, fmt.Errorf("invalid array %q", text)
+	}
+	return list, nil
+}
+
+type arrayParser struct {
+	text     string
+	pos      int
+	elemType string
+}
+
+func (p *arrayParser) parse() ([]any, error) {
+	if p.pos >= len(p.text) || p.text[p.pos] != '{' {
+		return nil, fmt.Errorf("invalid array %q", p.text)
+	}
+	p.pos++
+	list := []any{}
+	if p.pos < len(p.text) && p.text[p.pos] == '}' {
+		p.pos++
+		return list, nil
+	}
+	for {
+		if p.pos >= len(p.text) {
+			return nil, fmt.Errorf("unterminated array %q", p.text)
+		}
+		switch p.text[p.pos] {
+		case '{':
+			sub, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, sub)
+		case '"':
+			s, err := p.quoted()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, arrayElement(s, p.elemType))
+		default:
+			start := p.pos
+			for p.pos < len(p.text) && p.text[p.pos] != ',' && p.text[p.pos] != '}' {
+				p.pos++
+			}
+			s := strings.TrimSpace(p.text[start:p.pos])
+			if strings.EqualFold(s, "NULL") {
+				list = append(list, nil)
+			} else {
+				list = append(list, arrayElement(s, p.elemType))
+			}
+		}
+
+		if p.pos >= len(p.text) {
+			return nil, fmt.Errorf("unterminated array %q", p.text)
+		}
+		c := p.text[p.pos]
+		p.pos++
+		if c == '}' {
+			return list, nil
+		}
+		if c != ',' {
+			return nil, fmt.Errorf("invalid array %q", p.text)
+		}
+	}
+}
+
+func (p *arrayParser) quoted() (string, error) {
+	var b strings.Builder
+	p.pos++
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		p.pos++
+		switch c {
+		case '\\':
+			if p.pos < len(p.text) {
+				b.WriteByte(p.text[p.pos])
+				p.pos++
+			}
+		case '"':
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted array element in %q", p.text)
+}
+
+// arrayElement converts the text of an array element by the element type, elements of types
+// without a JSON counterpart keep their text form
+func arrayElement(s string, elemType string) any {
+	switch elemType {
+	case "INT2", "INT4", "INT8":
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+	case "FLOAT4", "FLOAT8":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case "NUMERIC":
+		return json.Number(s)
+	case "BOOL":
+		return s == "t"
+	case "JSON", "JSONB":
+		return json.RawMessage(s)
+	}
+	return s
+}
+
+// referenceList converts the elements of an array to the reference values the mapper expands
+// through the uri value pattern. NULL elements are left out.
+func referenceList(list []any) []string {
+	refs := make([]string, 0, len(list))
+	for _, v := range list {
+		switch e := v.(type) {
+		case nil:
+		case []any:
+			refs = append(refs, referenceList(e)...)
+		default:
+			refs = append(refs, fmt.Sprint(e))
+		}
+	}
+	return refs
+}
+
+// arrayLiteral renders a list in the text form of an array. The literal is converted to the
+// element type of the column by the server, so it can be written to arrays of any type.
+func arrayLiteral(list []any) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, v := range list {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		switch e := v.(type) {
+		case nil:
+			b.WriteString("NULL")
+		case []any:
+			b.WriteString(arrayLiteral(e))
+		case []string:
+			b.WriteString(arrayLiteral(stringList(e)))
+		case bool:
+			b.WriteString(strconv.FormatBool(e))
+		case float64:
+			b.WriteString(strconv.FormatFloat(e, 'f', -1, 64))
+		case int:
+			b.WriteString(strconv.Itoa(e))
+		case int64:
+			b.WriteString(strconv.FormatInt(e, 10))
+		case json.Number:
+			b.WriteString(e.String())
+		case string:
+			b.WriteString(quoteArrayElement(e))
+		default:
+			data, _ := json.Marshal(e)
+			b.WriteString(quoteArrayElement(string(data)))
+		}
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func quoteArrayElement(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(s) + "\""
+}
+
+func stringList(values []string) []any {
+	list := make([]any, len(values))
+	for i, v := range values {
+		list[i] = v
+	}
+	return list
+}
@@ -0,0 +1,110 @@
+package layer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func TestScannedValue(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		buf  interface{ Scan(any) error }
+		src  any
+		want any
+	}{
+		{"numeric", &numericValue{}, "12345678901234567890.0123", json.Number("12345678901234567890.0123")},
+		{"null numeric", &numericValue{}, nil, nil},
+		{"int4", &sql.NullInt32{}, int64(7), int64(7)},
+		{"timestamptz", &sql.NullTime{}, ts, ts},
+		{"date", &dateValue{}, ts, "2024-01-02"},
+		{"bytea", &byteaValue{}, []byte{0x01, 0xab}, `\x01ab`},
+		{"uuid", &sql.NullString{}, "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"},
+		{"interval", &sql.NullString{}, "1 day 02:00:00", "1 day 02:00:00"},
+		{"int array", &arrayValue{elemType: "INT4"}, "{1,NULL,3}", []any{int64(1), nil, int64(3)}},
+		{"text array", &arrayValue{elemType: "TEXT"}, `{a,"b c","d\"e","NULL"}`, []any{"a", "b c", `d"e`, "NULL"}},
+		{"nested numeric array", &arrayValue{elemType: "NUMERIC"}, "{{1.10,2},{3,4}}", []any{[]any{json.Number("1.10"), json.Number("2")}, []any{json.Number("3"), json.Number("4")}}},
+		{"bool array with bounds", &arrayValue{elemType: "BOOL"}, "[0:1]={t,f}", []any{true, false}},
+		{"empty array", &arrayValue{elemType: "TEXT"}, "{}", []any{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.buf.Scan(tt.src); err != nil {
+				t.Fatal(err)
+			}
+			got := scannedValue(tt.buf)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseArrayRejectsInvalidText(t *testing.T) {
+	for _, text := range []string{"", "1,2", "{1,2", `{"a}`, "{1}x"} {
+		if _, err := parseArray(text, "INT4"); err == nil {
+			t.Errorf("expected error for %q", text)
+		}
+	}
+}
+
+func TestArrayLiteral(t *testing.T) {
+	list := []any{"a", `b "c"`, `d\e`, nil, 1.5, int64(2), true, []any{"x"}}
+	literal := arrayLiteral(list)
+	expected := `{"a","b \"c\"","d\\e",NULL,1.5,2,true,{"x"}}`
+	if literal != expected {
+		t.Fatalf("unexpected literal\n got: %s\nwant: %s", literal, expected)
+	}
+
+	parsed, err := parseArray(arrayLiteral([]any{"a", `b "c"`, `d\e`, nil}), "TEXT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, []any{"a", `b "c"`, `d\e`, nil}) {
+		t.Errorf("unexpected round trip %#v", parsed)
+	}
+}
+
+func TestReferenceArrays(t *testing.T) {
+	outgoing := &common.OutgoingMappingConfig{
+		BaseURI: "http://data.test.io/",
+		PropertyMappings: []*common.ItemToEntityPropertyMapping{
+			{Property: "id", IsIdentity: true, URIValuePattern: "http://data.test.io/product/{value}"},
+			{Property: "tags", EntityProperty: "tags"},
+			{Property: "related", EntityProperty: "related", IsReference: true, URIValuePattern: "http://data.test.io/product/{value}"},
+		},
+	}
+	mapper := common.NewMapper(nil, nil, outgoing)
+
+	related := &arrayValue{elemType: "INT4"}
+	tags := &arrayValue{elemType: "TEXT"}
+	if err := related.Scan("{2,NULL,3}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tags.Scan("{a,b}"); err != nil {
+		t.Fatal(err)
+	}
+	item := &RowItem{
+		Columns:    []string{"id", "tags", "related"},
+		Map:        map[string]any{"id": "1", "tags": tags, "related": related},
+		references: map[string]bool{"related": true},
+	}
+
+	entity := egdm.NewEntity()
+	if err := mapper.MapItemToEntity(item, entity); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entity.Properties["http://data.test.io/tags"], []any{"a", "b"}) {
+		t.Errorf("unexpected tags %#v", entity.Properties["http://data.test.io/tags"])
+	}
+	expected := []string{"http://data.test.io/product/2", "http://data.test.io/product/3"}
+	if !reflect.DeepEqual(entity.References["http://data.test.io/related"], expected) {
+		t.Errorf("unexpected references %#v", entity.References["http://data.test.io/related"])
+	}
+}
@@ -3,16 +3,69 @@ package layer
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"slices"
 	"strings"
+	"time"
 
 	common "github.com/mimiro-io/common-datalayer"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
 )
 
+// FullSync writes all batches of a sync into a staging table next to the target table.
+// The staging table is created by the start batch and tagged with the sync id, so that
+// batches from other or abandoned syncs are rejected. When the last batch is closed the
+// target table contents are replaced by the staging rows in a single transaction, the
+// live table is not touched before that.
 func (d *Dataset) FullSync(ctx context.Context, batchInfo common.BatchInfo) (common.DatasetWriter, common.LayerError) {
-	// TODO not supported (yet?)
-	return nil, ErrNotSupported
+	writer, err := d.newPgsqlWriter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(writer.relations) > 0 {
+		writer.lease()
+		return nil, common.Err(fmt.Errorf("full sync of dataset %s with relations not supported", d.datasetDefinition.DatasetName), common.LayerNotSupported)
+	}
+
+	columns, cerr := mappingColumns(d.datasetDefinition)
+	if cerr != nil {
+		writer.lease()
+		return nil, ErrGeneric("%s", cerr.Error())
+	}
+	target := writer.table
+	writer.table = tableRef(writer.schema, fullSyncTable(writer.tableName))
+	writer.fullSync = &fullSyncInfo{target: target, isLastBatch: batchInfo.IsLastBatch}
+	for _, c := range columns {
+		writer.fullSync.columns = append(writer.fullSync.columns, quoteIdentifier(c.name))
+	}
+
+	berr := writer.begin()
+	if berr != nil {
+		writer.lease()
+		return nil, common.Err(berr, common.LayerErrorInternal)
+	}
+
+	if batchInfo.IsStartBatch {
+		berr = writer.ensureTable(target, nil)
+		if berr == nil {
+			berr = writer.createFullSyncTable(batchInfo.SyncId)
+		}
+	} else {
+		var inProgress bool
+		inProgress, berr = writer.fullSyncInProgress(batchInfo.SyncId)
+		if berr == nil && !inProgress {
+			berr = fmt.Errorf("no full sync with id %s in progress for table %s", batchInfo.SyncId, target)
+			return nil, common.Err(writer.rollback(berr), common.LayerErrorBadParameter)
+		}
+	}
+	if berr != nil {
+		return nil, common.Err(writer.rollback(berr), common.LayerErrorInternal)
+	}
+	// the staging table exists from here on
+	writer.tableEnsured = true
+
+	return writer, nil
 }
 
 func (d *Dataset) Incremental(ctx context.Context) (common.DatasetWriter, common.LayerError) {
@@ -22,11 +75,25 @@ func (d *Dataset) Incremental(ctx context.Context) (common.DatasetWriter, common
 	}
 
 	berr := writer.begin()
+	if berr != nil {
+		writer.lease()
+	}
 	return writer, common.Err(berr, common.LayerErrorInternal)
 }
 
+// newPgsqlWriter returns a writer holding on to the pools of the dataset until it is closed
 func (d *Dataset) newPgsqlWriter(ctx context.Context) (*PgsqlWriter, common.LayerError) {
-	mapper := common.NewMapper(d.logger, d.datasetDefinition.IncomingMappingConfig, d.datasetDefinition.OutgoingMappingConfig)
+	d, lease := d.acquire()
+	writer, err := d.pgsqlWriter(ctx)
+	if err != nil {
+		lease()
+		return nil, err
+	}
+	writer.lease = lease
+	return writer, nil
+}
+
+func (d *Dataset) pgsqlWriter(ctx context.Context) (*PgsqlWriter, common.LayerError) {
 	db := d.db.db
 	tableName, ok := d.datasetDefinition.SourceConfig[TableName].(string)
 	if !ok {
@@ -41,95 +108,253 @@ func (d *Dataset) newPgsqlWriter(ctx context.Context) (*PgsqlWriter, common.Laye
 		}
 		flushThreshold = int(flushThresholdF)
 	}
+	entityColumn := getStringConfigProperty(d.datasetDefinition.SourceConfig, EntityColumn)
+	if d.datasetDefinition.IncomingMappingConfig == nil && entityColumn == "" {
+		return nil, ErrGeneric("incoming mapping config is missing for dataset %s", d.datasetDefinition.DatasetName)
+	}
+	// without incoming mapping only the entity column is written
+	var mapper *common.Mapper
 	idColumn := "id"
-	for _, m := range d.datasetDefinition.IncomingMappingConfig.PropertyMappings {
-		if m.IsIdentity {
-			idColumn = m.Property
-			break
+	if d.datasetDefinition.IncomingMappingConfig != nil {
+		mapper = common.NewMapper(d.logger, d.datasetDefinition.IncomingMappingConfig, d.datasetDefinition.OutgoingMappingConfig)
+		for _, m := range d.datasetDefinition.IncomingMappingConfig.PropertyMappings {
+			if m.IsIdentity {
+				idColumn = m.Property
+				break
+			}
 		}
 	}
 
 	sinceColumn, _ := d.datasetDefinition.SourceConfig[SinceColumn].(string)
 
+	writeStrategy := getStringConfigProperty(d.datasetDefinition.SourceConfig, WriteStrategy)
+	if writeStrategy == "" {
+		writeStrategy = InsertStrategy
+	}
+	if writeStrategy != InsertStrategy && writeStrategy != CopyStrategy {
+		return nil, ErrGeneric("unknown write strategy %s for dataset %s", writeStrategy, d.datasetDefinition.DatasetName)
+	}
+
+	var softDeleteColumn, softDeleteValue string
+	if getBooleanConfigProperty(d.datasetDefinition.SourceConfig, SoftDelete) && entityColumn == "" {
+		softDeleteColumn = getStringConfigProperty(d.datasetDefinition.SourceConfig, DeletedColumn)
+		if softDeleteColumn == "" {
+			return nil, ErrGeneric("soft delete requires a deleted column for dataset %s", d.datasetDefinition.DatasetName)
+		}
+		softDeleteValue = "TRUE"
+		if v, ok := d.datasetDefinition.SourceConfig[DeletedValue]; ok && v != nil {
+			softDeleteValue = sqlVal(v)
+		}
+	}
+
+	relations, rerr := incomingRelations(d.datasetDefinition, idColumn)
+	if rerr != nil {
+		return nil, ErrGeneric("%s", rerr.Error())
+	}
+
+	settings, rerr := sessionSettings(d.datasetDefinition.SourceConfig)
+	if rerr != nil {
+		return nil, ErrGeneric("%s", rerr.Error())
+	}
+
+	var tableColumns []*tableColumn
+	if getBooleanConfigProperty(d.datasetDefinition.SourceConfig, AutoCreate) {
+		tableColumns, rerr = mappingColumns(d.datasetDefinition)
+		if rerr != nil {
+			return nil, ErrGeneric("%s", rerr.Error())
+		}
+	}
+
 	return &PgsqlWriter{
-		logger:         d.logger,
-		mapper:         mapper,
-		sinceColumn:    sinceColumn,
-		db:             db,
-		ctx:            ctx,
-		table:          tableName,
-		flushThreshold: flushThreshold,
-		appendMode:     d.datasetDefinition.SourceConfig[AppendMode] == true,
-		idColumn:       idColumn,
+		logger:           d.logger,
+		mapper:           mapper,
+		sinceColumn:      sinceColumn,
+		db:               db,
+		ctx:              ctx,
+		table:            tableRef(d.schema(), tableName),
+		tableName:        tableName,
+		schema:           d.schema(),
+		flushThreshold:   flushThreshold,
+		appendMode:       d.datasetDefinition.SourceConfig[AppendMode] == true,
+		upsertMode:       getBooleanConfigProperty(d.datasetDefinition.SourceConfig, UpsertMode),
+		writeStrategy:    writeStrategy,
+		idColumn:         idColumn,
+		softDeleteColumn: softDeleteColumn,
+		softDeleteValue:  softDeleteValue,
+		relations:        relations,
+		entityColumn:     entityColumn,
+		deletedColumn:    getStringConfigProperty(d.datasetDefinition.SourceConfig, DeletedColumn),
+		deletedValue:     d.datasetDefinition.SourceConfig[DeletedValue],
+		tableColumns:     tableColumns,
+		settings:         settings,
+		batchIndex:       map[string]int{},
 	}, nil
 }
 
 type PgsqlWriter struct {
-	logger         common.Logger
-	ctx            context.Context
-	mapper         *common.Mapper
-	db             *sql.DB
-	tx             *sql.Tx
-	table          string
-	idColumn       string
+	logger   common.Logger
+	ctx      context.Context
+	mapper   *common.Mapper
+	db       *sql.DB
+	conn     *sql.Conn
+	tx       *sql.Tx
+	table    string
+	idColumn string
+	// tableName and schema are the unquoted names the quoted table is made of
+	tableName      string
+	schema         string
 	sinceColumn    string
-	batch          strings.Builder
-	deleteBatch    strings.Builder
-	batchSize      int
+	batch          []*RowItem
+	batchIndex     map[string]int
 	flushThreshold int
 	appendMode     bool
+	upsertMode     bool
+	writeStrategy  string
+	fullSync       *fullSyncInfo
+	// rolledBack is set once tx is rolled back, see rollback
+	rolledBack bool
+	// softDeleteColumn is set when deleted entities are marked by setting it to softDeleteValue
+	// instead of deleting their rows
+	softDeleteColumn string
+	softDeleteValue  string
+	// relations are written into their child tables, see childStatements
+	relations []*relation
+	// entityColumn is set when the entities are stored as JSON in it, see entityRow
+	entityColumn  string
+	deletedColumn string
+	deletedValue  any
+	// tableColumns is set when the table is created from the mapping, see ensureTable
+	tableColumns []*tableColumn
+	tableEnsured bool
+	// arrayColumns are the catalog names of the array columns per written table, see loadArrayColumns
+	arrayColumns map[string]map[string]bool
+	// settings are the timeouts of the dataset, set at the start of every transaction
+	settings []sessionSetting
+	// lease releases the pools of the dataset when the writer is done, see poolRegistry.acquire
+	lease func()
+}
+
+type fullSyncInfo struct {
+	target      string
+	isLastBatch bool
+	// columns are the quoted columns written by the dataset, the only ones copied into the target
+	columns []string
+}
+
+func fullSyncTable(table string) string {
+	return suffixName(table, "_fullsync")
 }
 
 func (o *PgsqlWriter) Write(entity *egdm.Entity) common.LayerError {
 	item := &RowItem{Map: map[string]any{}}
-	err := o.mapper.MapEntityToItem(entity, item)
+	var err error
+	if o.mapper != nil {
+		err = o.mapper.MapEntityToItem(entity, item)
+		if err != nil {
+			return common.Err(err, common.LayerErrorInternal)
+		}
+	}
+	if o.entityColumn != "" {
+		err = o.entityRow(entity, item)
+		if err != nil {
+			return common.Err(err, common.LayerErrorBadParameter)
+		}
+	} else {
+		// set the deleted flag, we always need this to do the right thing in upsert mode
+		item.deleted = entity.IsDeleted
+	}
+
+	err = o.extractChildren(item)
 	if err != nil {
-		return common.Err(err, common.LayerErrorInternal)
+		return common.Err(err, common.LayerErrorBadParameter)
 	}
-	// set the deleted flag, we always need this to do the right thing in upsert mode
-	item.deleted = entity.IsDeleted
 
-	// add delete statement to delete batch
-	if o.deleteBatch.Len() == 0 {
-		o.deleteBatch.WriteString("DELETE FROM ")
-		o.deleteBatch.WriteString(o.table)
-		o.deleteBatch.WriteString(" WHERE ")
+	// the last version of an entity in a batch wins, both for deletes and for upserts
+	key := fmt.Sprint(item.Map[o.idColumn])
+	if i, found := o.batchIndex[key]; found {
+		o.batch[i] = item
 	} else {
-		o.deleteBatch.WriteString(" OR ")
+		o.batchIndex[key] = len(o.batch)
+		o.batch = append(o.batch, item)
 	}
-	o.deleteBatch.WriteString(o.idColumn)
-	o.deleteBatch.WriteString(" = ")
-	o.deleteBatch.WriteString(sqlVal(item.Map[o.idColumn]))
 
-	// if the entity is deleted continue
-	if entity.IsDeleted {
-		return nil
+	if len(o.batch) >= o.flushThreshold {
+		err = o.flush()
+		if err != nil {
+			return common.Err(err, common.LayerErrorInternal)
+		}
 	}
+	return nil
+}
 
-	err = o.insert(item)
-
+// entityRow adds the entity, serialised with expanded namespaces, to the row as the entity
+// column. The identity is written to the identity column unless it is mapped, and the deleted
+// flag to the deleted column. Deleted entities are kept as rows, so that they are read back
+// as deleted.
+func (o *PgsqlWriter) entityRow(entity *egdm.Entity, item *RowItem) error {
+	data, err := json.Marshal(entity)
 	if err != nil {
-		return common.Err(err, common.LayerErrorInternal)
+		return err
 	}
-	if o.batchSize >= o.flushThreshold {
-		err = o.flush()
+	item.SetValue(columnKey(o.entityColumn), string(data))
+	if _, found := item.Map[o.idColumn]; !found {
+		item.SetValue(o.idColumn, entity.ID)
+	}
+	if o.deletedColumn != "" {
+		var deleted any = entity.IsDeleted
+		if o.deletedValue != nil {
+			deleted = nil
+			if entity.IsDeleted {
+				deleted = o.deletedValue
+			}
+		}
+		col := columnKey(o.deletedColumn)
+		if _, found := item.Map[col]; found {
+			item.Map[col] = deleted
+		} else {
+			item.SetValue(col, deleted)
+		}
+	}
+	return nil
+}
+
+// extractChildren moves the relation properties of a mapped row into child table rows
+func (o *PgsqlWriter) extractChildren(item *RowItem) error {
+	for _, rel := range o.relations {
+		i := slices.IndexFunc(item.Columns, func(c string) bool { return strings.EqualFold(c, rel.Property) })
+		if i < 0 {
+			continue
+		}
+		col := item.Columns[i]
+		rows, err := rel.childRows(item.Map[col], item.Map[rel.Key])
 		if err != nil {
-			return common.Err(err, common.LayerErrorInternal)
+			return err
+		}
+		if item.children == nil {
+			item.children = map[string][]*RowItem{}
 		}
-		o.batchSize = 0
-		o.batch.Reset()
-		o.deleteBatch.Reset()
+		item.children[rel.Property] = rows
+		item.Columns = slices.Delete(item.Columns, i, i+1)
+		delete(item.Map, col)
 	}
 	return nil
 }
 
 func (o *PgsqlWriter) Close() common.LayerError {
+	defer o.lease()
 	err := o.flush()
 	if err != nil {
 		return common.Err(err, common.LayerErrorInternal)
 	}
+	if o.fullSync != nil && o.fullSync.isLastBatch {
+		err = o.replaceFullSyncTarget()
+		if err != nil {
+			return common.Err(err, common.LayerErrorInternal)
+		}
+	}
 	if o.tx != nil {
 		err = o.tx.Commit()
+		o.release()
 		if err != nil {
 			return common.Err(err, common.LayerErrorInternal)
 		}
@@ -140,97 +365,403 @@ func (o *PgsqlWriter) Close() common.LayerError {
 }
 
 func sqlVal(v any) string {
-	switch v.(type) {
+	switch val := v.(type) {
 	case string:
-		return fmt.Sprintf("'%s'", v)
+		return "'" + strings.ReplaceAll(val, "'", "''") + "'"
 	case nil:
 		return "NULL"
 	case bool:
 		return fmt.Sprintf("'%t'", v)
+	case time.Time:
+		return sqlVal(val.Format(time.RFC3339Nano))
+	case map[string]any, *egdm.Entity, json.RawMessage, []any, []string:
+		// nested objects and lists are written as JSON, like the values of the COPY strategy
+		b, _ := json.Marshal(val)
+		return sqlVal(string(b))
 	default:
 		return fmt.Sprintf("%v", v)
 	}
 }
 
+// columnVal renders the value of a column. Lists are written as array literals to array
+// columns, and as JSON to all other columns.
+func columnVal(v any, array bool) string {
+	switch val := v.(type) {
+	case []any:
+		if array {
+			return sqlVal(arrayLiteral(val))
+		}
+	case []string:
+		if array {
+			return sqlVal(arrayLiteral(stringList(val)))
+		}
+	}
+	return sqlVal(v)
+}
+
+// arrayColumnsQuery returns the array columns of a table
+const arrayColumnsQuery = `SELECT a.attname FROM pg_attribute a JOIN pg_type t ON t.oid = a.atttypid
+	WHERE a.attrelid = to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped AND t.typcategory = 'A'`
+
+// loadArrayColumns looks up the array columns of the tables written by the writer, once per
+// writer and after ensureTable, so that lists are only written as arrays to array columns
+func (o *PgsqlWriter) loadArrayColumns() error {
+	tables := []string{o.table}
+	for _, rel := range o.relations {
+		tables = append(tables, tableRef(o.schema, rel.Table))
+	}
+	if o.arrayColumns == nil {
+		o.arrayColumns = map[string]map[string]bool{}
+	}
+	for _, table := range tables {
+		if _, ok := o.arrayColumns[table]; ok {
+			continue
+		}
+		columns, err := o.catalogColumns(arrayColumnsQuery, table)
+		if err != nil {
+			return o.rollback(err)
+		}
+		o.arrayColumns[table] = columns
+	}
+	return nil
+}
+
+// isArray returns whether the column of the table is an array column, see loadArrayColumns
+func (o *PgsqlWriter) isArray(table string, col string) bool {
+	return o.arrayColumns[table][identifierName(col)]
+}
+
 func (o *PgsqlWriter) flush() error {
-	if o.batchSize == 0 {
+	if len(o.batch) == 0 {
 		return nil
 	}
 
-	// execute the batch
-	delstmt := o.deleteBatch.String()
-	stmt := o.batch.String()
-	stmt = "BEGIN;\n\n" + delstmt + ";\n" + stmt
-	stmt += ";\nCOMMIT;"
-
-	o.logger.Debug(stmt)
-	_, err := o.tx.ExecContext(o.ctx, stmt)
+	err := o.ensureTable(o.table, o.batch)
+	if err != nil {
+		return err
+	}
+	err = o.loadArrayColumns()
+	if err != nil {
+		return err
+	}
+	if o.writeStrategy == CopyStrategy {
+		err = o.copyBatch()
+	} else {
+		err = o.exec(o.batchStatements()...)
+	}
 	if err != nil {
-		if o.tx != nil {
-			err2 := o.tx.Rollback()
-			if err2 != nil {
-				o.logger.Error("Failed to rollback transaction")
-				return fmt.Errorf("failed to rollback transaction: %w, underlying: %w", err2, err)
-			}
-			o.logger.Debug("Transaction rolled back")
-		}
 		return err
 	}
 
+	o.batch = o.batch[:0]
+	o.batchIndex = map[string]int{}
 	return nil
 }
 
-func (o *PgsqlWriter) insert(item *RowItem) error {
-	if o.batch.Len() == 0 {
-		// Start building the INSERT statement
-		o.batch.WriteString("INSERT INTO ")
-		o.batch.WriteString(o.table)
-		o.batch.WriteString(" (")
-		for i, col := range item.Columns {
+// batchStatements renders the pending batch. In the default mode every row in the batch
+// is deleted and the live rows are inserted again. In upsert mode only deleted entities
+// are removed and the live rows are merged with INSERT ... ON CONFLICT on the identity column.
+// With soft delete, deleted entities are marked in the deleted column instead of removed.
+func (o *PgsqlWriter) batchStatements() []string {
+	deleteIds, softDeleteIds, rows := o.splitBatch()
+	childDeletes, childInserts := o.childStatements()
+
+	stmts := append(childDeletes, o.deleteStatements(deleteIds, softDeleteIds)...)
+	if len(rows) > 0 {
+		stmts = append(stmts, o.insertStatement(rows))
+	}
+	return append(stmts, childInserts...)
+}
+
+// splitBatch returns the quoted identities to delete, the quoted identities to soft delete
+// and the rows to write for the pending batch
+func (o *PgsqlWriter) splitBatch() ([]string, []string, []*RowItem) {
+	var deleteIds, softDeleteIds []string
+	var rows []*RowItem
+	for _, item := range o.batch {
+		if item.deleted && o.softDeleteColumn != "" {
+			softDeleteIds = append(softDeleteIds, sqlVal(item.Map[o.idColumn]))
+			continue
+		}
+		if item.deleted || !o.upsertMode {
+			deleteIds = append(deleteIds, sqlVal(item.Map[o.idColumn]))
+		}
+		if !item.deleted {
+			rows = append(rows, item)
+		}
+	}
+	return deleteIds, softDeleteIds, rows
+}
+
+func (o *PgsqlWriter) deleteStatements(deleteIds []string, softDeleteIds []string) []string {
+	var stmts []string
+	if len(deleteIds) > 0 {
+		stmts = append(stmts, o.deleteStatement(deleteIds))
+	}
+	if len(softDeleteIds) > 0 {
+		stmts = append(stmts, o.softDeleteStatement(softDeleteIds))
+	}
+	return stmts
+}
+
+func (o *PgsqlWriter) deleteStatement(deleteIds []string) string {
+	return "DELETE FROM " + o.table + " WHERE " + quoteIdentifier(o.idColumn) + " IN (" + strings.Join(deleteIds, ", ") + ")"
+}
+
+func (o *PgsqlWriter) softDeleteStatement(ids []string) string {
+	stmt := "UPDATE " + o.table + " SET " + quoteIdentifier(o.softDeleteColumn) + " = " + o.softDeleteValue
+	if o.sinceColumn != "" {
+		stmt += ", " + quoteIdentifier(o.sinceColumn) + " = NOW()"
+	}
+	return stmt + " WHERE " + quoteIdentifier(o.idColumn) + " IN (" + strings.Join(ids, ", ") + ")"
+}
+
+// generatedColumns returns the quoted columns written by the layer itself in addition to the
+// mapped columns, with the value expression each is set to. A soft delete column that is not mapped
+// is reset to its default, so that entities written again are no longer marked as deleted.
+func (o *PgsqlWriter) generatedColumns(columns []string) ([]string, []string) {
+	var names, values []string
+	if o.sinceColumn != "" {
+		names = append(names, quoteIdentifier(o.sinceColumn))
+		values = append(values, "NOW()")
+	}
+	if o.softDeleteColumn != "" && !slices.ContainsFunc(columns, func(c string) bool {
+		return columnKey(c) == columnKey(o.softDeleteColumn)
+	}) {
+		names = append(names, quoteIdentifier(o.softDeleteColumn))
+		values = append(values, "DEFAULT")
+	}
+	return names, values
+}
+
+func (o *PgsqlWriter) insertStatement(rows []*RowItem) string {
+	columns := batchColumns(rows)
+	generated, generatedValues := o.generatedColumns(columns)
+
+	var b strings.Builder
+	b.WriteString("INSERT INTO ")
+	b.WriteString(o.table)
+	b.WriteString(" (")
+	for i, col := range columns {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(quoteIdentifier(col))
+	}
+	for _, col := range generated {
+		b.WriteString(", ")
+		b.WriteString(col)
+	}
+	b.WriteString(") VALUES")
+
+	for r, row := range rows {
+		if r > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(" (")
+		for i, col := range columns {
 			if i > 0 {
-				o.batch.WriteString(", ")
+				b.WriteString(", ")
 			}
-			o.batch.WriteString("\"")
-			o.batch.WriteString(strings.ToLower(col))
-			o.batch.WriteString("\"")
+			b.WriteString(columnVal(row.Map[col], o.isArray(o.table, col)))
 		}
+		for _, val := range generatedValues {
+			b.WriteString(", ")
+			b.WriteString(val)
+		}
+		b.WriteString(")")
+	}
+
+	b.WriteString(o.conflictClause(columns))
 
-		if o.sinceColumn != "" {
-			o.batch.WriteString(", \"")
-			o.batch.WriteString(strings.ToLower(o.sinceColumn))
-			o.batch.WriteString("\"")
+	return b.String()
+}
+
+// conflictClause returns the ON CONFLICT clause that turns an insert of the given columns
+// into an upsert on the identity column, or an empty string when not in upsert mode
+func (o *PgsqlWriter) conflictClause(columns []string) string {
+	if !o.upsertMode {
+		return ""
+	}
+
+	var updates []string
+	for _, col := range columns {
+		if columnKey(col) == columnKey(o.idColumn) {
+			continue
 		}
+		c := quoteIdentifier(col)
+		updates = append(updates, c+" = EXCLUDED."+c)
+	}
+	generated, _ := o.generatedColumns(columns)
+	for _, c := range generated {
+		updates = append(updates, c+" = EXCLUDED."+c)
+	}
 
-		o.batch.WriteString(") VALUES ")
-	} else {
-		// Add a comma before next set of values
-		o.batch.WriteString(",")
+	clause := " ON CONFLICT (" + quoteIdentifier(o.idColumn) + ") DO "
+	if len(updates) == 0 {
+		return clause + "NOTHING"
 	}
+	return clause + "UPDATE SET " + strings.Join(updates, ", ")
+}
 
-	// Build a single row of values in parentheses
-	o.batch.WriteString(" (")
-	for i, val := range item.Values {
-		if i > 0 {
-			o.batch.WriteString(", ")
+// batchColumns returns the union of mapped columns in the order they first appear,
+// rows missing a column are written as NULL
+func batchColumns(rows []*RowItem) []string {
+	var columns []string
+	seen := map[string]bool{}
+	for _, row := range rows {
+		for _, col := range row.Columns {
+			if !seen[col] {
+				seen[col] = true
+				columns = append(columns, col)
+			}
 		}
-		o.batch.WriteString(sqlVal(val))
 	}
+	return columns
+}
 
-	if o.sinceColumn != "" {
-		o.batch.WriteString(", NOW()")
+// fullSyncMarker starts the comment of the staging tables, it is followed by the sync id
+const fullSyncMarker = "pgsql layer full sync "
+
+// createFullSyncTable replaces the staging table of an earlier sync by an empty one tagged with
+// the sync id. A table of the same name that is not a staging table is left alone.
+func (o *PgsqlWriter) createFullSyncTable(syncId string) error {
+	exists, comment, err := o.stagingTable()
+	if err != nil {
+		return o.rollback(err)
+	}
+	if exists && !strings.HasPrefix(comment, fullSyncMarker) {
+		return o.rollback(fmt.Errorf("table %s exists and is not a full sync staging table", o.table))
+	}
+	stmts := []string{
+		"DROP TABLE IF EXISTS " + o.table,
+		"CREATE UNLOGGED TABLE " + o.table + " (LIKE " + o.fullSync.target + " INCLUDING DEFAULTS INCLUDING INDEXES)",
+		"COMMENT ON TABLE " + o.table + " IS " + sqlVal(fullSyncMarker+syncId),
+	}
+	err = o.exec(stmts...)
+	if err != nil {
+		return err
 	}
+	return o.dropNotNull()
+}
 
-	o.batch.WriteString(")")
+// notNullQuery returns the columns of a table that are NOT NULL without being part of its primary key
+const notNullQuery = `SELECT a.attname FROM pg_attribute a WHERE a.attrelid = to_regclass($1) AND a.attnum > 0
+	AND NOT a.attisdropped AND a.attnotnull AND NOT EXISTS (SELECT 1 FROM pg_index i
+	WHERE i.indrelid = a.attrelid AND i.indisprimary AND a.attnum = ANY(i.indkey)) ORDER BY a.attnum`
 
-	o.batchSize++
+// dropNotNull lifts the NOT NULL constraints the staging table copied from the target. Columns
+// the dataset does not write, such as identity columns, are NULL in the staging table and are
+// filled by the target when the staging rows are copied into it.
+func (o *PgsqlWriter) dropNotNull() error {
+	rows, err := o.tx.QueryContext(o.ctx, notNullQuery, o.table)
+	if err != nil {
+		return o.rollback(err)
+	}
+	var alters []string
+	for rows.Next() {
+		var col string
+		if err = rows.Scan(&col); err != nil {
+			break
+		}
+		alters = append(alters, "ALTER COLUMN "+quoteExact(col)+" DROP NOT NULL")
+	}
+	_ = rows.Close()
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		return o.rollback(err)
+	}
+	if len(alters) == 0 {
+		return nil
+	}
+	return o.exec("ALTER TABLE " + o.table + " " + strings.Join(alters, ", "))
+}
+
+// fullSyncInProgress returns whether the staging table is tagged with the sync id
+func (o *PgsqlWriter) fullSyncInProgress(syncId string) (bool, error) {
+	exists, comment, err := o.stagingTable()
+	return exists && comment == fullSyncMarker+syncId, err
+}
+
+// stagingTable returns whether the staging table exists, and its comment
+func (o *PgsqlWriter) stagingTable() (bool, string, error) {
+	var exists bool
+	var comment sql.NullString
+	err := o.tx.QueryRowContext(o.ctx, "SELECT to_regclass($1) IS NOT NULL, obj_description(to_regclass($1), 'pg_class')", o.table).Scan(&exists, &comment)
+	return exists, comment.String, err
+}
+
+// replaceFullSyncTarget replaces the target rows by the staging rows. Only the columns written
+// by the dataset are copied, so that generated and identity columns of the target are filled
+// by the target itself.
+func (o *PgsqlWriter) replaceFullSyncTarget() error {
+	columns := strings.Join(o.fullSync.columns, ", ")
+	stmts := []string{
+		"DELETE FROM " + o.fullSync.target,
+		"INSERT INTO " + o.fullSync.target + " (" + columns + ") SELECT " + columns + " FROM " + o.table,
+		"DROP TABLE " + o.table,
+	}
+	return o.exec(stmts...)
+}
+
+// exec runs the statements in the writer transaction, rolling it back on the first failure
+func (o *PgsqlWriter) exec(stmts ...string) error {
+	for _, stmt := range stmts {
+		o.logger.Debug(stmt)
+		_, err := o.tx.ExecContext(o.ctx, stmt)
+		if err != nil {
+			return o.rollback(err)
+		}
+	}
 	return nil
 }
 
+// rollback aborts the writer transaction after err and releases the connection. Rolling back
+// again, after a step that rolled back itself, only returns err.
+func (o *PgsqlWriter) rollback(err error) error {
+	if o.rolledBack {
+		return err
+	}
+	o.rolledBack = true
+	err2 := o.tx.Rollback()
+	o.release()
+	// the writer is not used after a failure
+	o.lease()
+	if err2 != nil && err2 != sql.ErrTxDone {
+		o.logger.Error("Failed to rollback transaction")
+		return fmt.Errorf("failed to rollback transaction: %w, underlying: %w", err2, err)
+	}
+	o.logger.Debug("Transaction rolled back")
+	return err
+}
+
+func (o *PgsqlWriter) release() {
+	if o.conn != nil {
+		_ = o.conn.Close()
+		o.conn = nil
+	}
+}
+
 func (o *PgsqlWriter) begin() error {
-	tx, err := o.db.Begin()
+	// the writer holds on to a single connection, so that session state like temporary
+	// tables and the COPY protocol can be used inside the transaction
+	conn, err := o.db.Conn(o.ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := conn.BeginTx(o.ctx, nil)
 	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if err = applySessionSettings(o.ctx, tx, o.settings); err != nil {
+		_ = tx.Rollback()
+		_ = conn.Close()
 		return err
 	}
+	o.conn = conn
 	o.tx = tx
 	o.logger.Debug("Transaction started")
 	return nil
@@ -0,0 +1,224 @@
+package layer
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func testWriter(upsert bool) *PgsqlWriter {
+	incoming := &common.IncomingMappingConfig{
+		BaseURI: "http://data.test.io/product/",
+		PropertyMappings: []*common.EntityToItemPropertyMapping{
+			{Property: "id", IsIdentity: true, StripReferencePrefix: true},
+			{Property: "name", EntityProperty: "name"},
+		},
+	}
+	return &PgsqlWriter{
+		mapper:         common.NewMapper(nil, incoming, nil),
+		table:          tableRef("", "product"),
+		idColumn:       "id",
+		sinceColumn:    "updated",
+		flushThreshold: 100,
+		upsertMode:     upsert,
+		batchIndex:     map[string]int{},
+	}
+}
+
+func testEntity(id string, name string, deleted bool) *egdm.Entity {
+	e := egdm.NewEntity().SetID("http://data.test.io/product/" + id)
+	e.Properties["http://data.test.io/product/name"] = name
+	e.IsDeleted = deleted
+	return e
+}
+
+func TestBatchStatements(t *testing.T) {
+	t.Run("delete and insert mode", func(t *testing.T) {
+		w := testWriter(false)
+		w.Write(testEntity("1", "o'neil", false))
+		w.Write(testEntity("2", "b", true))
+
+		stmts := w.batchStatements()
+		expected := []string{
+			`DELETE FROM "product" WHERE "id" IN ('1', '2')`,
+			`INSERT INTO "product" ("id", "name", "updated") VALUES ('1', 'o''neil', NOW())`,
+		}
+		assertStatements(t, stmts, expected)
+	})
+
+	t.Run("upsert mode", func(t *testing.T) {
+		w := testWriter(true)
+		w.Write(testEntity("1", "a", false))
+		w.Write(testEntity("2", "b", true))
+		w.Write(testEntity("3", "c", false))
+		w.Write(testEntity("1", "a2", false))
+
+		stmts := w.batchStatements()
+		expected := []string{
+			`DELETE FROM "product" WHERE "id" IN ('2')`,
+			`INSERT INTO "product" ("id", "name", "updated") VALUES ('1', 'a2', NOW()), ('3', 'c', NOW()) ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "updated" = EXCLUDED."updated"`,
+		}
+		assertStatements(t, stmts, expected)
+	})
+
+	t.Run("last version in batch wins", func(t *testing.T) {
+		w := testWriter(false)
+		w.Write(testEntity("1", "a", false))
+		w.Write(testEntity("1", "a", true))
+
+		stmts := w.batchStatements()
+		assertStatements(t, stmts, []string{`DELETE FROM "product" WHERE "id" IN ('1')`})
+	})
+
+	t.Run("nested objects and times", func(t *testing.T) {
+		w := testWriter(false)
+		e := testEntity("1", "a", false)
+		e.Properties["http://data.test.io/product/name"] = map[string]any{"size": 2.0, "label": "o'neil"}
+		w.Write(e)
+		w.batch[0].Map["updated_at"] = time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)
+		w.batch[0].Columns = append(w.batch[0].Columns, "updated_at")
+
+		stmts := w.batchStatements()
+		expected := []string{
+			`DELETE FROM "product" WHERE "id" IN ('1')`,
+			`INSERT INTO "product" ("id", "name", "updated_at", "updated") VALUES ('1', '{"label":"o''neil","size":2}', '2024-01-02T10:30:00Z', NOW())`,
+		}
+		assertStatements(t, stmts, expected)
+	})
+
+	t.Run("soft delete", func(t *testing.T) {
+		w := testWriter(true)
+		w.softDeleteColumn = "deleted"
+		w.softDeleteValue = "TRUE"
+		w.Write(testEntity("1", "a", false))
+		w.Write(testEntity("2", "b", true))
+
+		stmts := w.batchStatements()
+		expected := []string{
+			`UPDATE "product" SET "deleted" = TRUE, "updated" = NOW() WHERE "id" IN ('2')`,
+			`INSERT INTO "product" ("id", "name", "updated", "deleted") VALUES ('1', 'a', NOW(), DEFAULT) ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "updated" = EXCLUDED."updated", "deleted" = EXCLUDED."deleted"`,
+		}
+		assertStatements(t, stmts, expected)
+	})
+}
+
+func TestEntityColumnWrite(t *testing.T) {
+	w := testWriter(true)
+	w.mapper = nil
+	w.entityColumn = "entity"
+	w.deletedColumn = "deleted"
+
+	if err := w.Write(testEntity("1", "car", false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(testEntity("2", "bike", true)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`INSERT INTO "product" ("entity", "id", "deleted", "updated") VALUES ` +
+			`('{"id":"http://data.test.io/product/1","refs":{},"props":{"http://data.test.io/product/name":"car"}}', 'http://data.test.io/product/1', 'false', NOW()), ` +
+			`('{"id":"http://data.test.io/product/2","deleted":true,"refs":{},"props":{"http://data.test.io/product/name":"bike"}}', 'http://data.test.io/product/2', 'true', NOW()) ` +
+			`ON CONFLICT ("id") DO UPDATE SET "entity" = EXCLUDED."entity", "deleted" = EXCLUDED."deleted", "updated" = EXCLUDED."updated"`,
+	}
+	assertStatements(t, w.batchStatements(), expected)
+}
+
+func TestChildStatements(t *testing.T) {
+	w := testWriter(true)
+	w.mapper = common.NewMapper(nil, &common.IncomingMappingConfig{
+		BaseURI: "http://data.test.io/product/",
+		PropertyMappings: []*common.EntityToItemPropertyMapping{
+			{Property: "id", IsIdentity: true, StripReferencePrefix: true},
+			{Property: "name", EntityProperty: "name"},
+			{Property: "parts", EntityProperty: "parts"},
+		},
+	}, nil)
+	w.relations = []*relation{{
+		Property:        "parts",
+		Table:           "part",
+		ForeignKey:      "product_id",
+		Key:             "id",
+		IdColumn:        "id",
+		URIValuePattern: "http://data.test.io/part/{value}",
+		BaseURI:         "http://data.test.io/part/",
+	}}
+
+	part := egdm.NewEntity().SetID("http://data.test.io/part/p1")
+	part.Properties["http://data.test.io/part/name"] = "wheel"
+	e := testEntity("1", "car", false)
+	e.Properties["http://data.test.io/product/parts"] = []any{part}
+	if err := w.Write(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(testEntity("2", "bike", true)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`DELETE FROM "part" WHERE "product_id" IN ('1', '2')`,
+		`DELETE FROM "product" WHERE "id" IN ('2')`,
+		`INSERT INTO "product" ("id", "name", "updated") VALUES ('1', 'car', NOW()) ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "updated" = EXCLUDED."updated"`,
+		`INSERT INTO "part" ("id", "name", "product_id") VALUES ('p1', 'wheel', '1')`,
+	}
+	assertStatements(t, w.batchStatements(), expected)
+
+	e.Properties["http://data.test.io/product/parts"] = []any{"not a part"}
+	if err := w.Write(e); err == nil {
+		t.Error("expected error for child values that are not sub-entities or objects")
+	}
+}
+
+func TestInsertStatementWritesListsAsArrays(t *testing.T) {
+	w := testWriter(false)
+	w.sinceColumn = ""
+	w.arrayColumns = map[string]map[string]bool{`"product"`: {"tags": true, "related": true}}
+	rows := []*RowItem{{
+		Columns: []string{"id", "tags", "related", "labels"},
+		Map:     map[string]any{"id": "1", "tags": []any{"a", "o'neil"}, "related": []string{"2", "3"}, "labels": []any{"x", 2.0}},
+	}}
+	// lists are written as arrays to array columns only, and as JSON to other columns
+	expected := `INSERT INTO "product" ("id", "tags", "related", "labels") VALUES ('1', '{"a","o''neil"}', '{"2","3"}', '["x",2]')`
+	if stmt := w.insertStatement(rows); stmt != expected {
+		t.Errorf("unexpected statement\n got: %s\nwant: %s", stmt, expected)
+	}
+
+	var b strings.Builder
+	if err := writeCopyRows(&b, rows, rows[0].Columns, w.arrayColumns[`"product"`]); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "\"1\",\"{\"\"a\"\",\"\"o'neil\"\"}\",\"{\"\"2\"\",\"\"3\"\"}\",\"[\"\"x\"\",2]\"\n"; b.String() != expected {
+		t.Errorf("unexpected copy data\n got: %q\nwant: %q", b.String(), expected)
+	}
+}
+
+func assertStatements(t *testing.T, stmts []string, expected []string) {
+	t.Helper()
+	if len(stmts) != len(expected) {
+		t.Fatalf("expected %d statements, got %d: %v", len(expected), len(stmts), stmts)
+	}
+	for i := range expected {
+		if stmts[i] != expected[i] {
+			t.Errorf("statement %d\n got: %s\nwant: %s", i, stmts[i], expected[i])
+		}
+	}
+}
+
+func TestWriteCopyRows(t *testing.T) {
+	rows := []*RowItem{
+		{Map: map[string]any{"id": "1", "name": `say "hi"`, "price": 1000000.0, "active": true}},
+		{Map: map[string]any{"id": "2", "name": "", "price": nil}},
+	}
+	var b strings.Builder
+	err := writeCopyRows(&b, rows, []string{"id", "name", "price", "active"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "\"1\",\"say \"\"hi\"\"\",\"1000000\",\"true\"\n\"2\",\"\",,\n"
+	if b.String() != expected {
+		t.Errorf("unexpected copy data\n got: %q\nwant: %q", b.String(), expected)
+	}
+}